@@ -1,72 +1,933 @@
 package main
 
 import (
+    "bufio"
+    "bytes"
+    "encoding/base64"
+    "encoding/hex"
     "encoding/json"
+    "errors"
+    "flag"
     "fmt"
+    "io"
+    "iter"
+    "math"
+    "math/big"
     "os"
     "reflect"
+    "sort"
+    "strconv"
+    "strings"
     "./jksn"
 )
 
+// Exit codes
+const (
+    exit_ok = 0
+    // The input is not valid JSON or JKSN, or cannot be converted
+    exit_data_error = 1
+    // The command line is wrong
+    exit_usage = 2
+    // A file cannot be opened, read or written
+    exit_io_error = 3
+)
+
+type command struct {
+    name    string
+    usage   string
+    summary string
+    run     func(flags *flag.FlagSet, args []string) int
+}
+
+var commands []command
+
+func init() {
+    commands = []command{
+        { "encode", "[-o output] [input ...]", "convert JSON to JKSN", run_encode },
+        { "decode", "[-o output] [input ...]", "convert JKSN to JSON, one document per line", run_decode },
+        { "validate", "[input ...]", "check that the input is valid JKSN", run_validate },
+        { "inspect", "[-o output] [-summary] [input ...]", "print an annotated disassembly of a JKSN stream", run_inspect },
+        { "assemble", "[-o output] [input ...]", "write the JKSN stream described by a listing", run_assemble },
+        { "diff", "[-o output] [-summary] old new", "list the changes between two JKSN documents as a JSON Patch", run_diff },
+        { "patch", "[-o output] patch [input ...]", "apply a JSON Patch written by diff to JKSN documents", run_patch },
+        { "query", "[-o output] [-json] expression [input ...]", "write the values an expression selects from JKSN documents", run_query },
+        { "stats", "[-o output] [input ...]", "report the size of JKSN input against JSON and gzip'd JSON", run_stats },
+    }
+}
+
 func main() {
-    is_encoding := true
-    for _, arg := range os.Args {
-        if arg == "-d" {
-            is_encoding = false
+    os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+    // Without a command, behave like the original converter: encode, or
+    // decode if -d is given
+    if len(args) == 0 || args[0] == "-d" || (strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "-help" && args[0] != "--help") {
+        legacy_args := make([]string, 0, len(args))
+        name := "encode"
+        for _, arg := range args {
+            if arg == "-d" {
+                name = "decode"
+            } else {
+                legacy_args = append(legacy_args, arg)
+            }
+        }
+        args = append([]string{ name }, legacy_args...)
+    }
+    for _, cmd := range commands {
+        if cmd.name == args[0] {
+            flags := flag.NewFlagSet("jksn "+cmd.name, flag.ContinueOnError)
+            flags.Usage = func() {
+                fmt.Fprintf(flags.Output(), "usage: jksn %s %s\n\n%s\n", cmd.name, cmd.usage, cmd.summary)
+                flags.PrintDefaults()
+            }
+            return cmd.run(flags, args[1:])
         }
     }
+    print_usage()
+    if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+        return exit_ok
+    }
+    return exit_usage
+}
 
-    if is_encoding {
-        json_decoder := json.NewDecoder(os.Stdin)
-        var value interface{}
-        err := json_decoder.Decode(&value)
-        if err != nil {
-            panic(err.Error())
+func print_usage() {
+    fmt.Fprintln(os.Stderr, "usage: jksn <command> [options] [input ...]")
+    fmt.Fprintln(os.Stderr)
+    fmt.Fprintln(os.Stderr, "Inputs default to standard input; \"-\" also names it.")
+    fmt.Fprintln(os.Stderr, "Output goes to standard output unless -o is given.")
+    fmt.Fprintln(os.Stderr)
+    fmt.Fprintln(os.Stderr, "commands:")
+    for _, cmd := range commands {
+        fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+    }
+}
+
+// parse_flags parses the options of a command, which may come before, after
+// or between the inputs, and returns the inputs. If the command should not
+// run, ok is false and code is the exit code.
+func parse_flags(flags *flag.FlagSet, args []string) (inputs []string, code int, ok bool) {
+    for {
+        if err := flags.Parse(args); err == flag.ErrHelp {
+            return nil, exit_ok, false
+        } else if err != nil {
+            return nil, exit_usage, false
         }
-        jksn_encoder := jksn.NewEncoder(os.Stdout)
-        err = jksn_encoder.Encode(value)
-        if err != nil {
-            panic(err.Error())
+        rest := flags.Args()
+        if len(rest) == 0 {
+            return inputs, exit_ok, true
+        }
+        if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+            return append(inputs, rest...), exit_ok, true
+        }
+        inputs, args = append(inputs, rest[0]), rest[1:]
+    }
+}
+
+// output is where a command writes its result.
+type output struct {
+    *bufio.Writer
+    file    *os.File
+    path    string
+}
+
+func create_output(path string) (*output, error) {
+    if path == "" || path == "-" {
+        return &output{ bufio.NewWriter(os.Stdout), nil, "standard output" }, nil
+    }
+    file, err := os.Create(path)
+    if err != nil {
+        return nil, err
+    }
+    return &output{ bufio.NewWriter(file), file, path }, nil
+}
+
+func (self *output) Close() error {
+    err := self.Flush()
+    if self.file != nil {
+        if close_err := self.file.Close(); err == nil {
+            err = close_err
+        }
+    }
+    return err
+}
+
+// for_each_input calls fn with each input named on the command line, or with
+// standard input if there is none. It stops at the first failing input and
+// returns its exit code.
+func for_each_input(names []string, fn func(name string, reader io.Reader) int) int {
+    if len(names) == 0 {
+        names = []string{ "-" }
+    }
+    for _, name := range names {
+        var code int
+        if name == "-" {
+            code = fn("standard input", bufio.NewReader(os.Stdin))
+        } else {
+            file, err := os.Open(name)
+            if err != nil {
+                return report("", err)
+            }
+            code = fn(name, bufio.NewReader(file))
+            file.Close()
+        }
+        if code != exit_ok {
+            return code
+        }
+    }
+    return exit_ok
+}
+
+// report prints err for the input name and returns the matching exit code.
+func report(name string, err error) int {
+    message := strings.TrimPrefix(err.Error(), "jksn: ")
+    var syntax_err *jksn.SyntaxError
+    if errors.As(err, &syntax_err) && !strings.Contains(message, "offset") {
+        message = fmt.Sprintf("%s (offset %d)", message, syntax_err.Offset)
+    }
+    var json_err *json.SyntaxError
+    if errors.As(err, &json_err) {
+        message = fmt.Sprintf("invalid JSON: %s (offset %d)", message, json_err.Offset)
+    }
+    if name != "" {
+        message = name + ": " + message
+    }
+    fmt.Fprintln(os.Stderr, "jksn: "+message)
+    var read_err *jksn.ReadError
+    var path_err *os.PathError
+    if errors.As(err, &read_err) || errors.As(err, &path_err) {
+        return exit_io_error
+    }
+    return exit_data_error
+}
+
+func run_encode(flags *flag.FlagSet, args []string) int {
+    output_path := flags.String("o", "", "write to `file` instead of standard output")
+    records := flags.Bool("ndjson", false, "read every JSON value of the input as a record, as in newline-delimited JSON")
+    array := flags.Bool("array", false, "write the records as one lengthless array instead of a document each")
+    shared := flags.Bool("shared", false, "let records refer to strings, blobs and integers of earlier records")
+    extended := flags.Bool("extended", false, "read the extended JSON that decode -extended writes")
+    max_buffer := flags.Int("max-buffer", 1024, "fail on a JSON object that takes more than `MiB` of memory to convert, or 0 for no limit")
+    inputs, code, ok := parse_flags(flags, args)
+    if !ok {
+        return code
+    }
+    out, err := create_output(*output_path)
+    if err != nil {
+        return report("", err)
+    }
+    jksn_encoder := jksn.NewEncoder(out)
+    jksn_encoder.SetMaxBuffer(*max_buffer << 20)
+    encode, transcode := jksn_encoder.Encode, jksn_encoder.EncodeJSON
+    if *array {
+        encode, transcode = jksn_encoder.EncodeElement, jksn_encoder.EncodeJSONElement
+        if err := jksn_encoder.BeginArray(); err != nil {
+            return report(out.path, err)
+        }
+    }
+    code = for_each_input(inputs, func(name string, reader io.Reader) int {
+        json_decoder := json.NewDecoder(reader)
+        json_decoder.UseNumber()
+        for count := 0; ; count++ {
+            if !*shared {
+                jksn_encoder.Reset()
+            }
+            var err error
+            if *extended {
+                // Extended JSON objects can only be recognized once read whole
+                var value interface{}
+                if err = json_decoder.Decode(&value); err == nil {
+                    if value, err = jksn.ValueFromExtendedJSON(value); err == nil {
+                        err = encode(value)
+                    }
+                }
+            } else {
+                err = transcode(json_decoder)
+            }
+            if err == io.EOF && (*records || count != 0) {
+                return exit_ok
+            } else if err != nil {
+                if err == io.EOF {
+                    err = io.ErrUnexpectedEOF
+                }
+                return report(name, err)
+            }
+            if !*records {
+                return exit_ok
+            }
+        }
+    })
+    if *array && code == exit_ok {
+        if err := jksn_encoder.EndArray(); err != nil {
+            return report(out.path, err)
+        }
+    }
+    if err := out.Close(); err != nil && code == exit_ok {
+        return report(out.path, err)
+    }
+    return code
+}
+
+func run_decode(flags *flag.FlagSet, args []string) int {
+    output_path := flags.String("o", "", "write to `file` instead of standard output")
+    split := flags.Bool("split", false, "write each element of a top-level array on a line of its own")
+    extended := flags.Bool("extended", false, "write blobs, NaN, big integers and other values JSON lacks as extended JSON objects")
+    options := json_flags(flags)
+    inputs, code, ok := parse_flags(flags, args)
+    if !ok {
+        return code
+    }
+    if err := options.check(); err != nil {
+        fmt.Fprintln(os.Stderr, "jksn: "+err.Error())
+        return exit_usage
+    }
+    out, err := create_output(*output_path)
+    if err != nil {
+        return report("", err)
+    }
+    code = for_each_input(inputs, func(name string, reader io.Reader) int {
+        for value, err := range decoded_values(reader, *split, *extended) {
+            if err != nil {
+                return report(name, err)
+            }
+            if code := options.write_line(out, name, value); code != exit_ok {
+                return code
+            }
+        }
+        return exit_ok
+    })
+    if err := out.Close(); err != nil && code == exit_ok {
+        return report(out.path, err)
+    }
+    return code
+}
+
+// decoded_values yields the documents of a JKSN stream, or the elements of
+// its top-level arrays if split is set, ready to be written as JSON.
+func decoded_values(reader io.Reader, split bool, extended bool) iter.Seq2[interface{}, error] {
+    return func(yield func(interface{}, error) bool) {
+        switch {
+        case split && extended:
+            for value, err := range jksn.Each[jksn.Value](reader) {
+                if !yield(value.ExtendedJSON(), err) {
+                    return
+                }
+            }
+        case split:
+            for value, err := range jksn.Each[interface{}](reader) {
+                if !yield(value, err) {
+                    return
+                }
+            }
+        default: {
+            jksn_decoder := jksn.NewDecoder(reader)
+            for {
+                var value interface{}
+                var err error
+                if extended {
+                    var extended_value jksn.Value
+                    err = jksn_decoder.Decode(&extended_value)
+                    value = extended_value.ExtendedJSON()
+                } else {
+                    err = jksn_decoder.Decode(&value)
+                }
+                if err == io.EOF || !yield(value, err) || err != nil {
+                    return
+                }
+            }
+        }
+        }
+    }
+}
+
+func run_validate(flags *flag.FlagSet, args []string) int {
+    inputs, code, ok := parse_flags(flags, args)
+    if !ok {
+        return code
+    }
+    return for_each_input(inputs, func(name string, reader io.Reader) int {
+        jksn_decoder := jksn.NewDecoder(reader)
+        documents := 0
+        for {
+            var value interface{}
+            err := jksn_decoder.Decode(&value)
+            if err == io.EOF {
+                break
+            } else if err != nil {
+                return report(name, err)
+            }
+            documents++
+        }
+        fmt.Printf("%s: OK, %d documents, %d bytes\n", name, documents, jksn_decoder.InputOffset())
+        return exit_ok
+    })
+}
+
+func run_inspect(flags *flag.FlagSet, args []string) int {
+    output_path := flags.String("o", "", "write to `file` instead of standard output")
+    summary := flags.Bool("summary", false, "print one line per document instead of a disassembly")
+    inputs, code, ok := parse_flags(flags, args)
+    if !ok {
+        return code
+    }
+    out, err := create_output(*output_path)
+    if err != nil {
+        return report("", err)
+    }
+    code = for_each_input(inputs, func(name string, reader io.Reader) int {
+        if !*summary {
+            if len(inputs) > 1 {
+                fmt.Fprintf(out, "; %s\n", name)
+            }
+            if err := jksn.Disassemble(reader, out); err != nil {
+                return report(name, err)
+            }
+            return exit_ok
+        }
+        jksn_decoder := jksn.NewDecoder(reader)
+        for document := 0; ; document++ {
+            start := jksn_decoder.InputOffset()
+            value, err := jksn_decoder.DecodeLazy()
+            if err == io.EOF {
+                return exit_ok
+            } else if err != nil {
+                return report(name, err)
+            }
+            fmt.Fprintf(out, "%s: document %d at offset %d, %d bytes: %s\n", name, document, start, jksn_decoder.InputOffset() - start, describe_lazy(value))
+        }
+    })
+    if err := out.Close(); err != nil && code == exit_ok {
+        return report(out.path, err)
+    }
+    return code
+}
+
+func run_assemble(flags *flag.FlagSet, args []string) int {
+    output_path := flags.String("o", "", "write to `file` instead of standard output")
+    inputs, code, ok := parse_flags(flags, args)
+    if !ok {
+        return code
+    }
+    out, err := create_output(*output_path)
+    if err != nil {
+        return report("", err)
+    }
+    code = for_each_input(inputs, func(name string, reader io.Reader) int {
+        if err := jksn.Assemble(reader, out); err != nil {
+            return report(name, err)
+        }
+        return exit_ok
+    })
+    if err := out.Close(); err != nil && code == exit_ok {
+        return report(out.path, err)
+    }
+    return code
+}
+
+func run_diff(flags *flag.FlagSet, args []string) int {
+    output_path := flags.String("o", "", "write to `file` instead of standard output")
+    summary := flags.Bool("summary", false, "print one line per change instead of a JSON Patch")
+    inputs, code, ok := parse_flags(flags, args)
+    if !ok {
+        return code
+    }
+    if len(inputs) != 2 {
+        flags.Usage()
+        return exit_usage
+    }
+    var documents [2]*jksn.Value
+    for i := range documents {
+        code = for_each_input(inputs[i:i+1], func(name string, reader io.Reader) int {
+            documents[i] = new(jksn.Value)
+            if err := jksn.NewDecoder(reader).Decode(documents[i]); err != nil {
+                if err == io.EOF {
+                    err = io.ErrUnexpectedEOF
+                }
+                return report(name, err)
+            }
+            return exit_ok
+        })
+        if code != exit_ok {
+            return code
+        }
+    }
+    out, err := create_output(*output_path)
+    if err != nil {
+        return report("", err)
+    }
+    patch := jksn.Diff(documents[0], documents[1])
+    if *summary {
+        for _, op := range patch {
+            switch op.Op {
+            case "add":
+                fmt.Fprintf(out, "added %s: %s\n", op.Path, extended_text(op.Value))
+            case "remove":
+                fmt.Fprintf(out, "removed %s: %s\n", op.Path, extended_text(op.Old))
+            default:
+                fmt.Fprintf(out, "changed %s: %s → %s\n", op.Path, extended_text(op.Old), extended_text(op.Value))
+            }
         }
     } else {
-        jksn_decoder := jksn.NewDecoder(os.Stdin)
-        var value interface{}
-        err := jksn_decoder.Decode(&value)
+        // One operation per line, so that patches diff well themselves
+        fmt.Fprint(out, "[")
+        for i, op := range patch {
+            data, err := json.Marshal(op)
+            if err != nil {
+                return report("", err)
+            }
+            if i != 0 {
+                fmt.Fprint(out, ",")
+            }
+            fmt.Fprintf(out, "\n%s", data)
+        }
+        fmt.Fprintln(out, "\n]")
+    }
+    if err := out.Close(); err != nil {
+        return report(out.path, err)
+    }
+    return exit_ok
+}
+
+func extended_text(value *jksn.Value) string {
+    data, _ := json.Marshal(value)
+    return string(data)
+}
+
+func run_patch(flags *flag.FlagSet, args []string) int {
+    output_path := flags.String("o", "", "write to `file` instead of standard output")
+    inputs, code, ok := parse_flags(flags, args)
+    if !ok {
+        return code
+    }
+    if len(inputs) == 0 {
+        flags.Usage()
+        return exit_usage
+    }
+    var patch jksn.Patch
+    code = for_each_input(inputs[:1], func(name string, reader io.Reader) int {
+        if err := json.NewDecoder(reader).Decode(&patch); err != nil {
+            return report(name, err)
+        }
+        return exit_ok
+    })
+    if code != exit_ok {
+        return code
+    }
+    out, err := create_output(*output_path)
+    if err != nil {
+        return report("", err)
+    }
+    jksn_encoder := jksn.NewEncoder(out)
+    code = for_each_input(inputs[1:], func(name string, reader io.Reader) int {
+        jksn_decoder := jksn.NewDecoder(reader)
+        for {
+            var value jksn.Value
+            if err := jksn_decoder.Decode(&value); err == io.EOF {
+                return exit_ok
+            } else if err != nil {
+                return report(name, err)
+            }
+            if err := patch.Apply(&value); err != nil {
+                return report(name, err)
+            }
+            if err := jksn_encoder.Encode(&value); err != nil {
+                return report(name, err)
+            }
+        }
+    })
+    if err := out.Close(); err != nil && code == exit_ok {
+        return report(out.path, err)
+    }
+    return code
+}
+
+func run_query(flags *flag.FlagSet, args []string) int {
+    output_path := flags.String("o", "", "write to `file` instead of standard output")
+    as_json := flags.Bool("json", false, "write JSON lines instead of JKSN")
+    extended := flags.Bool("extended", false, "with -json, write values JSON lacks as extended JSON objects")
+    options := json_flags(flags)
+    inputs, code, ok := parse_flags(flags, args)
+    if !ok {
+        return code
+    }
+    if len(inputs) == 0 {
+        flags.Usage()
+        return exit_usage
+    }
+    if err := options.check(); err != nil {
+        fmt.Fprintln(os.Stderr, "jksn: "+err.Error())
+        return exit_usage
+    }
+    filter, err := jksn.Query(inputs[0])
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return exit_usage
+    }
+    out, err := create_output(*output_path)
+    if err != nil {
+        return report("", err)
+    }
+    jksn_encoder := jksn.NewEncoder(out)
+    code = for_each_input(inputs[1:], func(name string, reader io.Reader) int {
+        for value, err := range filter.Run(jksn.NewDecoder(reader)) {
+            if err != nil {
+                return report(name, err)
+            }
+            switch {
+            case *as_json && *extended:
+                code = options.write_line(out, name, value.ExtendedJSON())
+            case *as_json:
+                code = options.write_line(out, name, value.Interface())
+            default:
+                if err := jksn_encoder.Encode(value); err != nil {
+                    return report(name, err)
+                }
+            }
+            if code != exit_ok {
+                return code
+            }
+        }
+        return exit_ok
+    })
+    if err := out.Close(); err != nil && code == exit_ok {
+        return report(out.path, err)
+    }
+    return code
+}
+
+func describe_lazy(value *jksn.LazyValue) string {
+    switch value.Kind() {
+    case jksn.KindArray:
+        return fmt.Sprintf("array of %d items", value.Len())
+    case jksn.KindObject: {
+        keys := make([]string, 0, value.Len())
+        for _, key := range value.Keys() {
+            keys = append(keys, fmt.Sprintf("%q", fmt.Sprint(key)))
+        }
+        return fmt.Sprintf("object with %d keys: %s", len(keys), strings.Join(keys, ", "))
+    }
+    default:
+        return value.Kind().String()
+    }
+}
+
+func run_stats(flags *flag.FlagSet, args []string) int {
+    output_path := flags.String("o", "", "write to `file` instead of standard output")
+    inputs, code, ok := parse_flags(flags, args)
+    if !ok {
+        return code
+    }
+    out, err := create_output(*output_path)
+    if err != nil {
+        return report("", err)
+    }
+    code = for_each_input(inputs, func(name string, reader io.Reader) int {
+        analysis, err := jksn.Analyze(reader)
         if err != nil {
-            panic(err.Error())
+            return report(name, err)
+        }
+        print_analysis(out, name, analysis)
+        return exit_ok
+    })
+    if err := out.Close(); err != nil && code == exit_ok {
+        return report(out.path, err)
+    }
+    return code
+}
+
+func print_analysis(out io.Writer, name string, analysis *jksn.Analysis) {
+    percent := func(part int64, whole int64) string {
+        if whole == 0 {
+            return "-"
+        }
+        return fmt.Sprintf("%.1f%%", float64(part) * 100 / float64(whole))
+    }
+    fmt.Fprintf(out, "%s: %d documents\n", name, analysis.Documents)
+    fmt.Fprintf(out, "  %-22s %10d bytes\n", "JKSN", analysis.Size)
+    fmt.Fprintf(out, "  %-22s %10d bytes, JKSN is %s of it\n", "JSON", analysis.JSONSize, percent(analysis.Size, analysis.JSONSize))
+    fmt.Fprintf(out, "  %-22s %10d bytes, JKSN is %s of it\n", "gzip'd JSON", analysis.GzipJSONSize, percent(analysis.Size, analysis.GzipJSONSize))
+    fmt.Fprintln(out, "bytes by kind:")
+    for kind := jksn.KindUndefined; kind <= jksn.KindUnspecified; kind++ {
+        if size := analysis.KindSize[kind]; size != 0 {
+            fmt.Fprintf(out, "  %-22s %10d bytes, %s\n", kind, size, percent(size, analysis.Size))
+        }
+    }
+    fmt.Fprintf(out, "  %-22s %10d bytes, %s\n", "headers and other", analysis.OverheadSize, percent(analysis.OverheadSize, analysis.Size))
+    fmt.Fprintln(out, "bytes saved by:")
+    for _, saving := range []struct{ name string; saving jksn.Saving }{
+        { "hash references", analysis.HashReferences },
+        { "delta integers", analysis.DeltaIntegers },
+        { "UTF-16 strings", analysis.UTF16Strings },
+        { "swapped arrays", analysis.SwappedArrays },
+    } {
+        fmt.Fprintf(out, "  %-22s %10d bytes in %d uses\n", saving.name, saving.saving.Bytes, saving.saving.Count)
+    }
+    if len(analysis.MissedStrings) != 0 {
+        fmt.Fprintln(out, "repeated strings missing from the hash table:")
+        for _, missed := range analysis.MissedStrings {
+            fmt.Fprintf(out, "  %-22s %10d bytes wasted, written %d times\n", strconv.Quote(missed.Text), missed.Wasted, missed.Count)
+        }
+    }
+}
+
+// json_options control how decoded values are written as JSON.
+type json_options struct {
+    indent      string
+    sort_keys   bool
+    // "number" or "string", for integers beyond the 53 bits of a double
+    bigints     string
+    // "base64", "hex" or "object", which writes {"$blob": "base64"}
+    blobs       string
+    // "error", "null" or "string", which writes "NaN", "Infinity" or
+    // "-Infinity"
+    nonfinite   string
+}
+
+func json_flags(flags *flag.FlagSet) *json_options {
+    options := new(json_options)
+    flags.Func("indent", "indent nested JSON values by `n` spaces, or by the given string", func(value string) error {
+        if n, err := strconv.Atoi(value); err == nil {
+            value = strings.Repeat(" ", n)
+        }
+        options.indent = value
+        return nil
+    })
+    flags.BoolVar(&options.sort_keys, "sort-keys", true, "sort object keys; otherwise they are written in no particular order")
+    flags.StringVar(&options.bigints, "bigints", "number", "write integers beyond 2^53 as a `number` or a string")
+    flags.StringVar(&options.blobs, "blobs", "base64", "write blobs as a `base64` string, a hex string or a {\"$blob\": base64} object")
+    flags.StringVar(&options.nonfinite, "nonfinite", "error", "treat NaN and infinities as an `error`, null or a string")
+    return options
+}
+
+func (self *json_options) check() error {
+    switch {
+    case self.bigints != "number" && self.bigints != "string":
+        return errors.New("-bigints must be number or string")
+    case self.blobs != "base64" && self.blobs != "hex" && self.blobs != "object":
+        return errors.New("-blobs must be base64, hex or object")
+    case self.nonfinite != "error" && self.nonfinite != "null" && self.nonfinite != "string":
+        return errors.New("-nonfinite must be error, null or string")
+    }
+    return nil
+}
+
+// write_line writes a decoded value as JSON followed by a newline.
+func (self *json_options) write_line(out io.Writer, name string, value interface{}) int {
+    var buf bytes.Buffer
+    if err := self.write(&buf, value, 0); err != nil {
+        return report(name, err)
+    }
+    buf.WriteByte('\n')
+    if _, err := out.Write(buf.Bytes()); err != nil {
+        return report(name, err)
+    }
+    return exit_ok
+}
+
+func (self *json_options) write(buf *bytes.Buffer, value interface{}, depth int) error {
+    switch value.(type) {
+    case nil:
+        buf.WriteString("null")
+    case bool:
+        buf.WriteString(strconv.FormatBool(value.(bool)))
+    case string:
+        self.write_string(buf, value.(string))
+    case json.Number:
+        buf.WriteString(string(value.(json.Number)))
+    case *big.Int: {
+        number := value.(*big.Int)
+        if self.bigints == "string" && number.BitLen() > 53 {
+            self.write_string(buf, number.String())
+        } else {
+            buf.WriteString(number.String())
+        }
+    }
+    case float64:
+        return self.write_float(buf, value.(float64), 64)
+    case float32:
+        return self.write_float(buf, float64(value.(float32)), 32)
+    case *big.Float: {
+        number := value.(*big.Float)
+        if number.IsInf() {
+            return self.write_float(buf, math.Inf(number.Sign()), 64)
+        }
+        buf.WriteString(number.Text('g', -1))
+    }
+    case []byte: {
+        blob := value.([]byte)
+        switch self.blobs {
+        case "hex":
+            self.write_string(buf, hex.EncodeToString(blob))
+        case "object":
+            buf.WriteString("{\"$blob\":")
+            if self.indent != "" {
+                buf.WriteByte(' ')
+            }
+            self.write_string(buf, base64.StdEncoding.EncodeToString(blob))
+            buf.WriteByte('}')
+        default:
+            self.write_string(buf, base64.StdEncoding.EncodeToString(blob))
+        }
+    }
+    case []interface{}: {
+        items := value.([]interface{})
+        buf.WriteByte('[')
+        for i, item := range items {
+            if i != 0 {
+                buf.WriteByte(',')
+            }
+            self.newline(buf, depth+1)
+            if err := self.write(buf, item, depth+1); err != nil {
+                return err
+            }
+        }
+        if len(items) != 0 {
+            self.newline(buf, depth)
+        }
+        buf.WriteByte(']')
+    }
+    case map[interface{}]interface{}: {
+        fields := value.(map[interface{}]interface{})
+        keys := make([]interface{}, 0, len(fields))
+        texts := make([]string, 0, len(fields))
+        for key := range fields {
+            text, err := self.json_key(key)
+            if err != nil {
+                return err
+            }
+            keys, texts = append(keys, key), append(texts, text)
+        }
+        if self.sort_keys {
+            sort.Sort(key_order{ keys, texts })
+        }
+        buf.WriteByte('{')
+        for i, key := range keys {
+            if i != 0 {
+                buf.WriteByte(',')
+            }
+            self.newline(buf, depth+1)
+            self.write_string(buf, texts[i])
+            buf.WriteByte(':')
+            if self.indent != "" {
+                buf.WriteByte(' ')
+            }
+            if err := self.write(buf, fields[key], depth+1); err != nil {
+                return err
+            }
         }
-        filter_map_key(&value)
-        json_encoder := json.NewEncoder(os.Stdout)
-        err = json_encoder.Encode(value)
+        if len(keys) != 0 {
+            self.newline(buf, depth)
+        }
+        buf.WriteByte('}')
+    }
+    default: {
+        // Anything else, such as swapped arrays of maps, goes through the
+        // interface{} forms above
+        generic := reflect.ValueOf(value)
+        switch generic.Kind() {
+        case reflect.Slice, reflect.Array: {
+            items := make([]interface{}, generic.Len())
+            for i := range items {
+                items[i] = generic.Index(i).Interface()
+            }
+            return self.write(buf, items, depth)
+        }
+        case reflect.Map: {
+            fields := make(map[interface{}]interface{}, generic.Len())
+            for _, key := range generic.MapKeys() {
+                fields[key.Interface()] = generic.MapIndex(key).Interface()
+            }
+            return self.write(buf, fields, depth)
+        }
+        }
+        data, err := json.Marshal(value)
         if err != nil {
-            panic(err.Error())
+            return err
         }
+        buf.Write(data)
+    }
     }
+    return nil
 }
 
-func filter_map_key(obj *interface{}) {
-    if *obj == nil {
-        return
+func (self *json_options) newline(buf *bytes.Buffer, depth int) {
+    if self.indent != "" {
+        buf.WriteByte('\n')
+        buf.WriteString(strings.Repeat(self.indent, depth))
     }
-    value := reflect.ValueOf(*obj)
-    switch value.Kind() {
-    case reflect.Array, reflect.Slice:
-        filtered := make([]interface{}, value.Len())
-        for i := 0; i < value.Len(); i++ {
-            new_value := value.Index(i).Interface()
-            filter_map_key(&new_value)
-            filtered[i] = new_value
-        }
-        *obj = filtered
-    case reflect.Map:
-        keys := value.MapKeys()
-        filtered := make(map[string]interface{}, len(keys))
-        for _, key := range keys {
-            key_str := fmt.Sprintf("%v", key.Interface())
-            new_value := value.MapIndex(key).Interface()
-            filter_map_key(&new_value)
-            filtered[key_str] = new_value
-        }
-        *obj = filtered
+}
+
+func (self *json_options) write_string(buf *bytes.Buffer, text string) {
+    data, _ := json.Marshal(text)
+    buf.Write(data)
+}
+
+// write_float formats a number as encoding/json does, except for NaN and
+// infinities.
+func (self *json_options) write_float(buf *bytes.Buffer, number float64, bits int) error {
+    if math.IsNaN(number) || math.IsInf(number, 0) {
+        switch self.nonfinite {
+        case "null":
+            buf.WriteString("null")
+        case "string":
+            self.write_string(buf, map[int]string{ 0: "NaN", 1: "Infinity", -1: "-Infinity" }[nonfinite_sign(number)])
+        default:
+            return errors.New("cannot write " + strconv.FormatFloat(number, 'g', -1, 64) + " as JSON, see -nonfinite")
+        }
+        return nil
     }
+    data, _ := json.Marshal(number)
+    if bits == 32 {
+        data, _ = json.Marshal(float32(number))
+    }
+    buf.Write(data)
+    return nil
+}
+
+func nonfinite_sign(number float64) int {
+    switch {
+    case math.IsInf(number, 1):
+        return 1
+    case math.IsInf(number, -1):
+        return -1
+    default:
+        return 0
+    }
+}
+
+// json_key returns the text of an object key. JSON keys are strings, so
+// other keys are given as the JSON text of their value, such as null or 1.5,
+// or as the string their value is written as.
+func (self *json_options) json_key(key interface{}) (string, error) {
+    if key_string, ok := key.(string); ok {
+        return key_string, nil
+    }
+    var buf bytes.Buffer
+    if err := self.write(&buf, key, 0); err != nil {
+        return "", err
+    }
+    text := buf.String()
+    if strings.HasPrefix(text, "\"") {
+        json.Unmarshal(buf.Bytes(), &text)
+    }
+    return text, nil
+}
+
+// key_order sorts object keys by their JSON text.
+type key_order struct {
+    keys  []interface{}
+    texts []string
+}
+
+func (self key_order) Len() int {
+    return len(self.keys)
+}
+
+func (self key_order) Less(i, j int) bool {
+    return self.texts[i] < self.texts[j]
+}
+
+func (self key_order) Swap(i, j int) {
+    self.keys[i], self.keys[j] = self.keys[j], self.keys[i]
+    self.texts[i], self.texts[j] = self.texts[j], self.texts[i]
 }
@@ -0,0 +1,457 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/base64"
+    "encoding/json"
+    "io"
+    "math/big"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Analysis reports where the bytes of a JKSN stream go, and how much its
+// compression techniques saved.
+type Analysis struct {
+    Documents       int
+    Size            int64
+    // Size of the documents as compact JSON, one per line, as the decode
+    // command writes them by default, and of that compressed by gzip
+    JSONSize        int64
+    GzipJSONSize    int64
+    // Bytes of control bytes, lengths and payloads by kind of value, not
+    // counting the items of containers. Swapped arrays count as arrays, and
+    // JSON literals as floats.
+    KindSize        map[Kind]int64
+    // Bytes of headers, padding, hashtable refreshers, checksums and pragmas
+    OverheadSize    int64
+    HashReferences  Saving
+    DeltaIntegers   Saving
+    UTF16Strings    Saving
+    SwappedArrays   Saving
+    // Strings written out in full more than once, most wasted bytes first
+    MissedStrings   []MissedString
+}
+
+// Saving counts the uses of a compression technique and the bytes they saved
+// over the plain encoding.
+type Saving struct {
+    Count   int
+    Bytes   int64
+}
+
+// MissedString is a string which was written out in full again instead of
+// as a hash reference, because its slot in the 256-entry hash table was taken
+// by another string in between, or the Encoder was reset.
+type MissedString struct {
+    Text    string
+    Count   int
+    // Bytes which references would have saved
+    Wasted  int64
+}
+
+// How many MissedStrings an Analysis lists
+const max_missed_strings = 10
+
+// Analyze reads a stream of JKSN documents and reports on its size.
+func Analyze(reader io.Reader) (*Analysis, error) {
+    result := &Analysis{ KindSize: make(map[Kind]int64) }
+    walker := &analyzer{ decoder: NewDecoder(reader), result: result, literals: make(map[string]*literal_stats) }
+    walker.decoder.trace, walker.decoder.capture = walker, new(bytes.Buffer)
+    // Each document is decoded again, from a copy of its bytes, to write
+    // it as JSON
+    var copies bytes.Buffer
+    json_decoder := NewDecoder(&copies)
+    var data bytes.Buffer
+    json_size := &counting_writer{}
+    gzip_size := &counting_writer{}
+    gzip_writer := gzip.NewWriter(gzip_size)
+    for {
+        walker.decoder.traceoffset = walker.decoder.readcount
+        if err := walker.decoder.begin_document(); err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        if walker.decoder.capture.Len() != 0 {
+            walker.decoder.traced(trace_header, 'j', 0, nil)
+        }
+        walker.decoder.skip_top_value()
+        if err := walker.decoder.result_err(); err != nil {
+            return nil, err
+        }
+        walker.end_swaps(0)
+        result.Documents++
+        copies.Write(walker.document.Bytes())
+        walker.document.Reset()
+        var value Value
+        if err := json_decoder.Decode(&value); err != nil {
+            return nil, err
+        }
+        data.Reset()
+        write_plain_json(&data, &value)
+        data.WriteByte('\n')
+        json_size.Write(data.Bytes())
+        gzip_writer.Write(data.Bytes())
+    }
+    gzip_writer.Close()
+    result.Size = walker.decoder.readcount
+    result.JSONSize, result.GzipJSONSize = json_size.count, gzip_size.count
+    result.MissedStrings = walker.missed_strings()
+    return result, nil
+}
+
+// write_plain_json writes a value as plain JSON, with blobs as base64
+// strings and big integers as numbers. NaN and infinities, which plain JSON
+// lacks, are written as null.
+func write_plain_json(buf *bytes.Buffer, value *Value) {
+    switch value.Kind() {
+    case KindUndefined, KindNull:
+        buf.WriteString("null")
+    case KindUnspecified:
+        // As encoding/json writes the unspecified value
+        buf.WriteString("{}")
+    case KindBool:
+        buf.WriteString(strconv.FormatBool(value.scalar.(bool)))
+    case KindInt:
+        buf.WriteString(value.scalar.(*big.Int).String())
+    case KindFloat:
+        write_plain_float(buf, value.scalar)
+    case KindString:
+        write_plain_string(buf, value.scalar.(string))
+    case KindBlob:
+        write_plain_string(buf, base64.StdEncoding.EncodeToString(value.scalar.([]byte)))
+    case KindArray: {
+        buf.WriteByte('[')
+        for i, item := range value.items {
+            if i != 0 {
+                buf.WriteByte(',')
+            }
+            write_plain_json(buf, item)
+        }
+        buf.WriteByte(']')
+    }
+    default: {
+        // Keys are sorted by their text, as the decode command does
+        keys := make([]interface{}, 0, len(value.fields))
+        texts := make([]string, 0, len(value.fields))
+        for key := range value.fields {
+            keys, texts = append(keys, key), append(texts, plain_json_key(key))
+        }
+        order := make([]int, len(keys))
+        for i := range order {
+            order[i] = i
+        }
+        sort.Slice(order, func(i, j int) bool {
+            return texts[order[i]] < texts[order[j]]
+        })
+        buf.WriteByte('{')
+        for i, index := range order {
+            if i != 0 {
+                buf.WriteByte(',')
+            }
+            write_plain_string(buf, texts[index])
+            buf.WriteByte(':')
+            write_plain_json(buf, value.fields[keys[index]])
+        }
+        buf.WriteByte('}')
+    }
+    }
+}
+
+func write_plain_float(buf *bytes.Buffer, number interface{}) {
+    switch number.(type) {
+    case float32, float64: {
+        var data []byte
+        var err error
+        if number_float32, ok := number.(float32); ok {
+            data, err = json.Marshal(number_float32)
+        } else {
+            data, err = json.Marshal(number.(float64))
+        }
+        if err != nil {
+            data = []byte("null")
+        }
+        buf.Write(data)
+    }
+    case *big.Float: {
+        if number.(*big.Float).IsInf() {
+            buf.WriteString("null")
+        } else {
+            buf.WriteString(number.(*big.Float).Text('g', -1))
+        }
+    }
+    case json.Number:
+        buf.WriteString(string(number.(json.Number)))
+    }
+}
+
+func write_plain_string(buf *bytes.Buffer, text string) {
+    data, _ := json.Marshal(text)
+    buf.Write(data)
+}
+
+// plain_json_key returns the text of an object key, which is the JSON text
+// of its value, or the string its value is written as.
+func plain_json_key(key interface{}) string {
+    if key_string, ok := key.(string); ok {
+        return key_string
+    }
+    var buf bytes.Buffer
+    write_plain_json(&buf, key_value(key))
+    text := buf.String()
+    if strings.HasPrefix(text, "\"") {
+        json.Unmarshal(buf.Bytes(), &text)
+    }
+    return text
+}
+
+type counting_writer struct {
+    count   int64
+}
+
+func (self *counting_writer) Write(data []byte) (int, error) {
+    self.count += int64(len(data))
+    return len(data), nil
+}
+
+// analyzer is the tracer of Analyze.
+type analyzer struct {
+    decoder     *Decoder
+    result      *Analysis
+    document    bytes.Buffer
+    // Encoded size of the string or blob which filled each hash table slot
+    textsize    [256]int64
+    blobsize    [256]int64
+    literals    map[string]*literal_stats
+    // The next string is the text of a JSON literal
+    json_literal    bool
+    // Swapped arrays being read, innermost last
+    swaps       []*swap_stats
+}
+
+type literal_stats struct {
+    count   int
+    first   int64
+    total   int64
+}
+
+type swap_stats struct {
+    depth   int
+    header  int64
+    columns []swap_column
+    // Number of cells present in each row
+    rows    []int
+}
+
+type swap_column struct {
+    key     int64
+    header  int64
+    cells   int
+    missing int
+}
+
+func (self *analyzer) trace(event *trace_event) {
+    self.document.Write(event.data)
+    self.end_swaps(event.depth)
+    for _, swap := range self.swaps {
+        swap.add(event)
+    }
+    size, control := int64(len(event.data)), event.control
+    // The text of a JSON literal counts as part of the number
+    text_kind := KindString
+    if self.json_literal {
+        self.json_literal, text_kind = false, KindFloat
+    }
+    switch {
+    case event.part == trace_header || control == 0xca || control & 0xf0 == 0x70 || control & 0xf0 == 0xf0:
+        self.result.OverheadSize += size
+    case control == 0x00:
+        self.result.KindSize[KindUndefined] += size
+    case control == 0x01:
+        self.result.KindSize[KindNull] += size
+    case control == 0x02 || control == 0x03:
+        self.result.KindSize[KindBool] += size
+    case control == 0x0f:
+        self.result.KindSize[KindFloat] += size
+        self.json_literal = true
+    case control & 0xf0 == 0x10:
+        self.result.KindSize[KindInt] += size
+    case control & 0xf0 == 0xd0: {
+        self.result.KindSize[KindInt] += size
+        if self.decoder.lastint != nil {
+            plain, _ := asm_int(self.decoder.lastint, "")
+            self.result.DeltaIntegers.add(int64(len(plain)) - size)
+        }
+    }
+    case control & 0xf0 == 0x20:
+        self.result.KindSize[KindFloat] += size
+    case control == 0x3c: {
+        self.result.KindSize[text_kind] += size
+        self.result.HashReferences.add(self.textsize[event.data[1]] - size)
+    }
+    case control & 0xf0 == 0x30 || control & 0xf0 == 0x40: {
+        self.result.KindSize[text_kind] += size
+        text := event.text(self.decoder)
+        self.textsize[djb_hash(event.data[header_length(event.data):])] = size
+        if control & 0xf0 == 0x30 {
+            as_utf8, _ := asm_header(0x40, 0, 12, uint64(len(text)), "", []byte(text))
+            self.result.UTF16Strings.add(int64(len(as_utf8)) - size)
+        }
+        stats := self.literals[text]
+        if stats == nil {
+            stats = &literal_stats{ first: size }
+            self.literals[text] = stats
+        }
+        stats.count++
+        stats.total += size
+    }
+    case control == 0x5c: {
+        self.result.KindSize[KindBlob] += size
+        self.result.HashReferences.add(self.blobsize[event.data[1]] - size)
+    }
+    case control & 0xf0 == 0x50: {
+        self.result.KindSize[KindBlob] += size
+        self.blobsize[djb_hash(event.data[header_length(event.data):])] = size
+    }
+    case control == 0xa0:
+        self.result.KindSize[KindUnspecified] += size
+    case control & 0xf0 == 0x90:
+        self.result.KindSize[KindObject] += size
+    case control & 0xf0 == 0xa0:
+        self.result.KindSize[KindArray] += size
+        self.swaps = append(self.swaps, &swap_stats{ depth: event.depth, header: size })
+    default:
+        self.result.KindSize[KindArray] += size
+    }
+}
+
+func (self *Saving) add(bytes int64) {
+    self.Count++
+    self.Bytes += bytes
+}
+
+// header_length returns the size of the control byte and length field of
+// a string or blob.
+func header_length(data []byte) int {
+    switch data[0] & 0xf {
+    case 0xd:
+        return 3
+    case 0xe:
+        return 2
+    case 0xf: {
+        length := 2
+        for length <= len(data) && data[length-1] & 0x80 != 0 {
+            length++
+        }
+        return length
+    }
+    default:
+        return 1
+    }
+}
+
+// add records the column names, column arrays and cells of a swapped array.
+func (self *swap_stats) add(event *trace_event) {
+    control := event.control
+    switch event.depth - self.depth {
+    case 1:
+        if len(self.columns) == 0 || self.columns[len(self.columns)-1].header != 0 {
+            self.columns = append(self.columns, swap_column{ key: int64(len(event.data)) })
+        } else {
+            self.columns[len(self.columns)-1].header = int64(len(event.data))
+        }
+    case 2: {
+        // Skip what is not a cell: padding, refreshers, checksums, pragmas
+        // and the checksum after a checksummed cell
+        if control == 0xca || control & 0xf0 == 0x70 || control == 0xff || (control & 0xf0 == 0xf0 && (control <= 0xf5 || event.part == trace_checksum)) {
+            return
+        }
+        column := &self.columns[len(self.columns)-1]
+        if control == 0xa0 {
+            column.missing++
+        } else {
+            for len(self.rows) <= column.cells {
+                self.rows = append(self.rows, 0)
+            }
+            self.rows[column.cells]++
+        }
+        column.cells++
+    }
+    }
+}
+
+// end_swaps counts the savings of the swapped arrays which end before a
+// value at depth.
+func (self *analyzer) end_swaps(depth int) {
+    for len(self.swaps) != 0 && self.swaps[len(self.swaps)-1].depth >= depth {
+        self.result.SwappedArrays.add(self.swaps[len(self.swaps)-1].saving())
+        self.swaps = self.swaps[:len(self.swaps)-1]
+    }
+}
+
+// saving compares a swapped array with an array of objects holding the same
+// cells, in which each key after the first is a hash reference.
+func (self *swap_stats) saving() int64 {
+    swapped, straight := self.header, int64(0)
+    rows := 0
+    for _, column := range self.columns {
+        swapped += column.key + column.header + int64(column.missing)
+        if present := column.cells - column.missing; present != 0 {
+            straight += column.key + int64(present - 1) * min(column.key, 2)
+        }
+        rows = max(rows, column.cells)
+    }
+    array_header, _ := asm_header(0x80, 0, 12, uint64(rows), "", nil)
+    straight += int64(len(array_header))
+    for row := 0; row < rows; row++ {
+        cells := 0
+        if row < len(self.rows) {
+            cells = self.rows[row]
+        }
+        object_header, _ := asm_header(0x90, 0, 12, uint64(cells), "", nil)
+        straight += int64(len(object_header))
+    }
+    return straight - swapped
+}
+
+func (self *analyzer) missed_strings() []MissedString {
+    var result []MissedString
+    for text, stats := range self.literals {
+        wasted := stats.total - stats.first - int64(stats.count - 1) * 2
+        if stats.count > 1 && wasted > 0 {
+            result = append(result, MissedString{ text, stats.count, wasted })
+        }
+    }
+    sort.Slice(result, func(i, j int) bool {
+        if result[i].Wasted != result[j].Wasted {
+            return result[i].Wasted > result[j].Wasted
+        }
+        return result[i].Text < result[j].Text
+    })
+    if len(result) > max_missed_strings {
+        result = result[:max_missed_strings]
+    }
+    return result
+}
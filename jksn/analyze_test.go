@@ -0,0 +1,89 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+ 
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+ 
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "compress/gzip"
+    "math"
+    "math/big"
+    "testing"
+)
+
+func TestAnalyzeJSONSize(t *testing.T) {
+    big_number, _ := new(big.Int).SetString("1267650600228229401496703205376", 10)
+    var stream bytes.Buffer
+    encoder := NewEncoder(&stream)
+    for _, document := range []interface{}{
+        map[string]interface{}{ "a": float32(0.1), "b": big_number, "c": []byte("hello"), "d": []interface{}{ 1, "x", nil, true } },
+        map[interface{}]interface{}{ 1: math.NaN(), nil: "<&>" },
+        []float32{ 0.1, 0.2, 0.3 },
+    } {
+        if err := encoder.Encode(document); err != nil {
+            t.Fatal(err)
+        }
+    }
+    analysis, err := Analyze(bytes.NewReader(stream.Bytes()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    json := `{"a":0.1,"b":1267650600228229401496703205376,"c":"aGVsbG8=","d":[1,"x",null,true]}` + "\n" +
+        `{"1":null,"null":"\u003c\u0026\u003e"}` + "\n" +
+        `[0.1,0.2,0.3]` + "\n"
+    if analysis.Documents != 3 || analysis.Size != int64(stream.Len()) || analysis.JSONSize != int64(len(json)) {
+        t.Errorf("%d documents of %d bytes, %d as JSON; expected 3 of %d, %d as JSON", analysis.Documents, analysis.Size, analysis.JSONSize, stream.Len(), len(json))
+    }
+    var gzip_json bytes.Buffer
+    gzip_writer := gzip.NewWriter(&gzip_json)
+    gzip_writer.Write([]byte(json))
+    gzip_writer.Close()
+    if analysis.GzipJSONSize != int64(gzip_json.Len()) {
+        t.Errorf("%d bytes of gzip'd JSON, expected %d", analysis.GzipJSONSize, gzip_json.Len())
+    }
+    total := analysis.OverheadSize
+    for _, size := range analysis.KindSize {
+        total += size
+    }
+    if total != analysis.Size {
+        t.Errorf("%d bytes by kind and overhead, expected %d", total, analysis.Size)
+    }
+}
+
+func TestAnalyzeSavings(t *testing.T) {
+    // "abc", two references to it, 1000 and a delta of 1 from it
+    hash := string([]byte{ djb_hash([]byte("abc")) })
+    stream := "jk!\x85\x43abc\x3c" + hash + "\x3c" + hash + "\x1c\x03\xe8\xd1"
+    analysis, err := Analyze(bytes.NewReader([]byte(stream)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if analysis.HashReferences != (Saving{ 2, 4 }) {
+        t.Errorf("hash references saved %+v, expected {Count:2 Bytes:4}", analysis.HashReferences)
+    }
+    if analysis.DeltaIntegers != (Saving{ 1, 2 }) {
+        t.Errorf("delta integers saved %+v, expected {Count:1 Bytes:2}", analysis.DeltaIntegers)
+    }
+    if analysis.KindSize[KindString] != 8 || analysis.KindSize[KindInt] != 4 || analysis.KindSize[KindArray] != 1 || analysis.OverheadSize != 3 {
+        t.Errorf("bytes by kind %v and overhead %d", analysis.KindSize, analysis.OverheadSize)
+    }
+    if json := "[\"abc\",\"abc\",\"abc\",1000,1001]\n"; analysis.JSONSize != int64(len(json)) {
+        t.Errorf("%d bytes of JSON, expected %d", analysis.JSONSize, len(json))
+    }
+}
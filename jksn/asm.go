@@ -0,0 +1,501 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "io"
+    "math"
+    "math/big"
+    "strconv"
+    "strings"
+    "unicode/utf16"
+)
+
+// Assemble reads a textual description of a JKSN stream and writes the exact
+// bytes it describes, for writing decoder test cases by hand. Each line holds
+// one mnemonic with its operands:
+//
+//     header                  the "jk!" header
+//     undefined, null, false, true, nan, inf, -inf, unspecified
+//     int 1017                an integer
+//     delta -4                a delta encoded integer
+//     float32 2.5, float64 1.5, float80 1.5
+//     str "text"              a UTF-8 string
+//     utf16 "text"            a UTF-16 string
+//     blob 62 6c 6f 62        a blob, in hex or as a quoted string
+//     ref 0x7a                a reference to the string with hash 0x7a
+//     blobref 0x7a            a reference to the blob with hash 0x7a
+//     json                    a JSON literal; a str line follows
+//     array 3                 an array header; its items follow
+//     object 2                an object header; its keys and values follow
+//     swapped 2               a row-col swapped array header; its column
+//                             names and column arrays follow
+//     lengthless              a lengthless array; unspecified ends it
+//     clear                   a hashtable refresher clearing both tables
+//     refresh 2               a hashtable refresher; its values follow
+//     pad                     a padding byte
+//     checksum crc32 de ad be ef
+//                             a checksum: djb, crc32, md5, sha1, sha256 or
+//                             sha512, with its bytes; they default to zeros
+//     checked crc32           a checksummed value; the value follows, then
+//                             a bytes line with the checksum
+//     pragma                  a pragma; its value follows
+//     bytes 6a 6b 21          raw bytes
+//
+// Integers, lengths and counts use the shortest encoding unless a size
+// suffix is given: int.8, int.16, int.32, int.var, delta.8, delta.16,
+// delta.32, delta.var, and .8, .16 or .var on str, utf16, blob, array,
+// object, swapped and refresh.
+//
+// A semicolon starts a comment, and text after "→" is ignored. The listing
+// written by Disassemble uses the same notation, and its offset and byte
+// columns are ignored too, so a listing assembles back to the same stream
+// unless the stream contains bytes Disassemble cannot describe.
+func Assemble(reader io.Reader, writer io.Writer) error {
+    scanner := bufio.NewScanner(reader)
+    scanner.Buffer(nil, 1 << 30)
+    buffered := bufio.NewWriter(writer)
+    for line := 1; scanner.Scan(); line++ {
+        tokens, err := asm_tokenize(asm_strip_listing(scanner.Text()))
+        if err == nil && len(tokens) != 0 {
+            var data []byte
+            data, err = asm_line(tokens)
+            buffered.Write(data)
+        }
+        if err != nil {
+            return errors.New("jksn: assembly line " + strconv.Itoa(line) + ": " + err.Error())
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return err
+    }
+    return buffered.Flush()
+}
+
+// Column where the text starts in a line written by disassembler.line
+const listing_text_column = 37
+
+func asm_strip_listing(line string) string {
+    if len(line) >= 10 && line[8:10] == "  " {
+        if _, err := strconv.ParseUint(line[:8], 16, 64); err == nil {
+            if len(line) <= listing_text_column {
+                return ""
+            }
+            return line[listing_text_column:]
+        }
+    }
+    return line
+}
+
+// asm_tokenize splits a line into words and quoted strings, which are
+// returned unquoted with a leading '"' to tell them apart.
+func asm_tokenize(line string) (tokens []string, err error) {
+    for {
+        line = strings.TrimLeft(line, " \t")
+        if line == "" || line[0] == ';' || strings.HasPrefix(line, "→") {
+            return
+        }
+        if line[0] == '"' {
+            quoted, err := strconv.QuotedPrefix(line)
+            if err != nil {
+                return nil, errors.New("bad string " + line)
+            }
+            text, _ := strconv.Unquote(quoted)
+            tokens = append(tokens, "\"" + text)
+            line = line[len(quoted):]
+            continue
+        }
+        end := strings.IndexAny(line, " \t;")
+        if end < 0 {
+            end = len(line)
+        }
+        tokens = append(tokens, line[:end])
+        line = line[end:]
+    }
+}
+
+func asm_line(tokens []string) ([]byte, error) {
+    mnemonic, suffix := tokens[0], ""
+    if dot := strings.IndexByte(mnemonic, '.'); dot > 0 {
+        mnemonic, suffix = mnemonic[:dot], mnemonic[dot:]
+    }
+    operands := tokens[1:]
+    if simple, ok := asm_simple[mnemonic]; ok {
+        if suffix != "" || len(operands) != 0 {
+            return nil, errors.New(mnemonic + " takes no operands")
+        }
+        return simple, nil
+    }
+    switch mnemonic {
+    case "int", "delta", "float32", "float64", "float80", "ref", "blobref", "array", "object", "swapped", "refresh", "checksum", "checked":
+        if len(operands) == 0 {
+            return nil, errors.New(mnemonic + " needs an operand")
+        }
+    }
+    switch mnemonic {
+    case "int", "delta": {
+        value, ok := new(big.Int).SetString(operands[0], 0)
+        if !ok || len(operands) != 1 {
+            return nil, errors.New("bad integer " + strings.Join(operands, " "))
+        }
+        if mnemonic == "int" {
+            return asm_int(value, suffix)
+        }
+        return asm_delta(value, suffix)
+    }
+    case "float32", "float64", "float80":
+        return asm_float(mnemonic, operands)
+    case "str", "utf16": {
+        if len(operands) != 1 || operands[0][0] != '"' {
+            return nil, errors.New(mnemonic + " needs one quoted string")
+        }
+        text := operands[0][1:]
+        if mnemonic == "str" {
+            return asm_header(0x40, 0, 12, uint64(len(text)), suffix, []byte(text))
+        }
+        runes := utf16.Encode([]rune(text))
+        payload := make([]byte, len(runes) * 2)
+        for i, r := range runes {
+            binary.LittleEndian.PutUint16(payload[i*2:], r)
+        }
+        return asm_header(0x30, 0, 11, uint64(len(runes)), suffix, payload)
+    }
+    case "blob", "bytes": {
+        payload, err := asm_bytes(operands)
+        if err != nil {
+            return nil, err
+        }
+        if mnemonic == "bytes" {
+            return payload, nil
+        }
+        return asm_header(0x50, 0, 11, uint64(len(payload)), suffix, payload)
+    }
+    case "ref", "blobref": {
+        hashvalue, err := strconv.ParseUint(operands[0], 0, 8)
+        if err != nil || len(operands) != 1 {
+            return nil, errors.New("bad hash " + strings.Join(operands, " "))
+        }
+        if mnemonic == "ref" {
+            return []byte{ 0x3c, uint8(hashvalue) }, nil
+        }
+        return []byte{ 0x5c, uint8(hashvalue) }, nil
+    }
+    case "array", "object", "swapped", "refresh": {
+        length, err := strconv.ParseUint(operands[0], 0, 64)
+        if err != nil || len(operands) != 1 {
+            return nil, errors.New("bad length " + strings.Join(operands, " "))
+        }
+        switch mnemonic {
+        case "array":
+            return asm_header(0x80, 0, 12, length, suffix, nil)
+        case "object":
+            return asm_header(0x90, 0, 12, length, suffix, nil)
+        case "swapped":
+            return asm_header(0xa0, 1, 12, length, suffix, nil)
+        default:
+            return asm_header(0x70, 1, 12, length, suffix, nil)
+        }
+    }
+    case "checksum", "checked": {
+        control, ok := asm_checksums[operands[0]]
+        if !ok {
+            return nil, errors.New("unknown checksum " + operands[0])
+        }
+        if mnemonic == "checked" {
+            if len(operands) != 1 {
+                return nil, errors.New("the checksum of checked goes in a bytes line after the value")
+            }
+            return []byte{ control | 0x08 }, nil
+        }
+        sum := make([]byte, checksum_length(control))
+        if len(operands) > 1 {
+            given, err := asm_bytes(operands[1:])
+            if err != nil {
+                return nil, err
+            }
+            if len(given) != len(sum) {
+                return nil, errors.New(operands[0] + " checksums have " + strconv.Itoa(len(sum)) + " bytes")
+            }
+            sum = given
+        }
+        return append([]byte{ control }, sum...), nil
+    }
+    }
+    return nil, errors.New("unknown mnemonic " + tokens[0])
+}
+
+var asm_simple = map[string][]byte{
+    "header": []byte("jk!"),
+    "undefined": { 0x00 },
+    "null": { 0x01 },
+    "false": { 0x02 },
+    "true": { 0x03 },
+    "json": { 0x0f },
+    "nan": { 0x20 },
+    "-inf": { 0x2e },
+    "inf": { 0x2f },
+    "clear": { 0x70 },
+    "unspecified": { 0xa0 },
+    "lengthless": { 0xc8 },
+    "pad": { 0xca },
+    "pragma": { 0xff },
+}
+
+var asm_checksums = map[string]uint8{
+    "djb": 0xf0,
+    "crc32": 0xf1,
+    "md5": 0xf2,
+    "sha1": 0xf3,
+    "sha256": 0xf4,
+    "sha512": 0xf5,
+}
+
+func checksum_mnemonic(control uint8) string {
+    for name, checksum := range asm_checksums {
+        if checksum == control & 0xf7 {
+            return name
+        }
+    }
+    return ""
+}
+
+// size_suffix names the size of an integer or length field, as decode_int.
+func size_suffix(size uint) string {
+    switch size {
+    case 1:
+        return ".8"
+    case 2:
+        return ".16"
+    case 4:
+        return ".32"
+    default:
+        return ".var"
+    }
+}
+
+// int_size returns the smallest field size holding value, as encode_int
+// writes it: signed for 1, 2 and 4 bytes, or 0 for a variable length field.
+func int_size(value *big.Int) uint {
+    switch {
+    case !value.IsInt64():
+        return 0
+    case value.Int64() >= math.MinInt8 && value.Int64() <= math.MaxInt8:
+        return 1
+    case value.Int64() >= math.MinInt16 && value.Int64() <= math.MaxInt16:
+        return 2
+    case value.Int64() >= math.MinInt32 && value.Int64() <= math.MaxInt32:
+        return 4
+    default:
+        return 0
+    }
+}
+
+// asm_size returns the field size a suffix asks for, or fallback if none.
+func asm_size(suffix string, fallback uint) (uint, error) {
+    switch suffix {
+    case "":
+        return fallback, nil
+    case ".8":
+        return 1, nil
+    case ".16":
+        return 2, nil
+    case ".32":
+        return 4, nil
+    case ".var":
+        return 0, nil
+    default:
+        return 0, errors.New("unknown size suffix " + suffix)
+    }
+}
+
+func asm_int(value *big.Int, suffix string) ([]byte, error) {
+    if suffix == "" && value.Sign() >= 0 && value.Cmp(big.NewInt(10)) <= 0 {
+        return []byte{ 0x10 | uint8(value.Int64()) }, nil
+    }
+    return asm_sized(value, suffix, map[uint]uint8{ 1: 0x1d, 2: 0x1c, 4: 0x1b, 0: 0x1f })
+}
+
+func asm_delta(value *big.Int, suffix string) ([]byte, error) {
+    if suffix == "" && value.Cmp(big.NewInt(-5)) >= 0 && value.Cmp(big.NewInt(5)) <= 0 {
+        if value.Sign() >= 0 {
+            return []byte{ 0xd0 | uint8(value.Int64()) }, nil
+        }
+        return []byte{ uint8(0xdb + value.Int64()) }, nil
+    }
+    return asm_sized(value, suffix, map[uint]uint8{ 1: 0xdd, 2: 0xdc, 4: 0xdb, 0: 0xdf })
+}
+
+// asm_sized writes an integer in a field of the size suffix asks for, using
+// the control byte for that size. Variable length fields hold the magnitude,
+// with the control byte before the positive one for negative numbers.
+func asm_sized(value *big.Int, suffix string, controls map[uint]uint8) ([]byte, error) {
+    size, err := asm_size(suffix, int_size(value))
+    if err != nil {
+        return nil, err
+    }
+    if size != 0 && (int_size(value) == 0 || int_size(value) > size) {
+        return nil, errors.New(value.String() + " does not fit in " + suffix)
+    }
+    encoder := new(Encoder)
+    if size == 0 && value.Sign() < 0 {
+        return append([]byte{ controls[0] - 1 }, encoder.encode_int(new(big.Int).Neg(value), 0)...), nil
+    }
+    return append([]byte{ controls[size] }, encoder.encode_int(value, size)...), nil
+}
+
+// asm_header writes the control byte and length field of a string, blob or
+// container, then its payload. Lengths from min to max fit in the control
+// byte; its low nibble is otherwise 0xe, 0xd or 0xf for a length in one
+// byte, two bytes or a variable length field.
+func asm_header(base uint8, min uint64, max uint64, length uint64, suffix string, payload []byte) ([]byte, error) {
+    var size uint
+    switch {
+    case suffix != "": {
+        var err error
+        if size, err = asm_size(suffix, 0); err != nil || size == 4 {
+            return nil, errors.New("bad size suffix " + suffix)
+        }
+    }
+    case length >= min && length <= max:
+        return append([]byte{ base | uint8(length) }, payload...), nil
+    case length <= 0xff:
+        size = 1
+    case length <= 0xffff:
+        size = 2
+    }
+    if (size == 1 && length > 0xff) || (size == 2 && length > 0xffff) {
+        return nil, errors.New(strconv.FormatUint(length, 10) + " does not fit in " + suffix)
+    }
+    result := []byte{ base | map[uint]uint8{ 1: 0xe, 2: 0xd, 0: 0xf }[size] }
+    result = append(result, new(Encoder).encode_int(new(big.Int).SetUint64(length), size)...)
+    return append(result, payload...), nil
+}
+
+// header_suffix returns the size suffix to write for a header, or "" if it
+// uses the encoding asm_header picks by default for its length.
+func header_suffix(control uint8, min uint64, max uint64, length uint64) string {
+    default_header, _ := asm_header(control & 0xf0, min, max, length, "", nil)
+    if default_header[0] == control {
+        return ""
+    }
+    return map[uint8]string{ 0xe: ".8", 0xd: ".16", 0xf: ".var" }[control & 0xf]
+}
+
+// number_suffix returns the size suffix to write for an integer or delta
+// control, or "" if asm_int or asm_delta picks it by default.
+func number_suffix(control uint8, value *big.Int) string {
+    var default_number []byte
+    if control & 0xf0 == 0x10 {
+        default_number, _ = asm_int(value, "")
+    } else {
+        default_number, _ = asm_delta(value, "")
+    }
+    if default_number[0] == control {
+        return ""
+    }
+    return map[uint8]string{ 0xb: ".32", 0xc: ".16", 0xd: ".8", 0xe: ".var", 0xf: ".var" }[control & 0xf]
+}
+
+func asm_bytes(operands []string) ([]byte, error) {
+    if len(operands) == 1 && operands[0] != "" && operands[0][0] == '"' {
+        return []byte(operands[0][1:]), nil
+    }
+    result, err := hex.DecodeString(strings.Join(operands, ""))
+    if err != nil {
+        return nil, errors.New("bad hex bytes " + strings.Join(operands, " "))
+    }
+    return result, nil
+}
+
+func asm_float(mnemonic string, operands []string) ([]byte, error) {
+    if len(operands) != 1 {
+        return nil, errors.New(mnemonic + " needs one number")
+    }
+    switch mnemonic {
+    case "float32": {
+        value, err := strconv.ParseFloat(operands[0], 32)
+        if err != nil {
+            return nil, errors.New("bad float " + operands[0])
+        }
+        return binary.BigEndian.AppendUint32([]byte{ 0x2d }, math.Float32bits(float32(value))), nil
+    }
+    case "float64": {
+        value, err := strconv.ParseFloat(operands[0], 64)
+        if err != nil {
+            return nil, errors.New("bad float " + operands[0])
+        }
+        return binary.BigEndian.AppendUint64([]byte{ 0x2c }, math.Float64bits(value)), nil
+    }
+    default: {
+        var buf [10]byte
+        if value, err := strconv.ParseFloat(operands[0], 64); err == nil && math.IsNaN(value) {
+            buf = [10]byte{ 0x7f, 0xff, 0xc0 }
+        } else {
+            value, _, err := big.ParseFloat(operands[0], 10, 64, big.ToNearestEven)
+            if err != nil {
+                return nil, errors.New("bad float " + operands[0])
+            }
+            buf = big_float_to_float80(value)
+        }
+        return append([]byte{ 0x2b }, buf[:]...), nil
+    }
+    }
+}
+
+// big_float_to_float80 is the inverse of float80_to_generic.
+func big_float_to_float80(value *big.Float) (buf [10]byte) {
+    if value.Signbit() {
+        buf[0] = 0x80
+    }
+    if value.IsInf() {
+        buf[0] |= 0x7f
+        buf[1], buf[2] = 0xff, 0x80
+        return
+    }
+    if value.Sign() == 0 {
+        return
+    }
+    mantissa := new(big.Float).SetPrec(64)
+    exponent := value.MantExp(mantissa) - 1 + 16383
+    if exponent >= 0x7fff {
+        buf[0] |= 0x7f
+        buf[1], buf[2] = 0xff, 0x80
+        return
+    }
+    // mantissa is in [0.5, 1); the explicit integer bit makes it 64 bits
+    mantissa.Abs(mantissa).SetMantExp(mantissa, 64)
+    bits, _ := mantissa.Uint64()
+    if exponent <= 0 {
+        if 1 - exponent >= 64 {
+            bits = 0
+        } else {
+            bits >>= uint(1 - exponent)
+        }
+        exponent = 0
+    }
+    buf[0] |= uint8(exponent >> 8)
+    buf[1] = uint8(exponent)
+    binary.BigEndian.PutUint64(buf[2:], bits)
+    return
+}
@@ -0,0 +1,88 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "math/rand"
+    "testing"
+)
+
+// disassemble_assemble checks that the listing of stream assembles back into
+// the same bytes.
+func disassemble_assemble(t *testing.T, stream []byte) {
+    var listing, result bytes.Buffer
+    if err := Disassemble(bytes.NewReader(stream), &listing); err != nil {
+        t.Fatalf("% x: %v", stream, err)
+    }
+    if err := Assemble(bytes.NewReader(listing.Bytes()), &result); err != nil {
+        t.Fatalf("% x: %v\n%s", stream, err, listing.Bytes())
+    }
+    if !bytes.Equal(result.Bytes(), stream) {
+        t.Errorf("% x assembled back as % x\n%s", stream, result.Bytes(), listing.Bytes())
+    }
+}
+
+func TestDisassembleAssemble(t *testing.T) {
+    streams := []string{
+        // Checksums, a pragma, an 80-bit float and a lengthless array of
+        // floats, deltas, a JSON literal, a UTF-16 string, a blob and
+        // references to both hash tables, with padding
+        "jk!\x93\xf8\x41a\x11\x00\x41b\xf1\x00\x00\x00\x00\xff\x01\x2b\x00\x00\x00\x00\x00\x00\x00\x80\xff\x3f" +
+            "\x41c\xc8\x2c\x3f\xf0\x00\x00\x00\x00\x00\x00\x2d\x3f\x80\x00\x00\x11\xd3\xd7\x0f\x4212\x31a\x00" +
+            "\x54blob\x5c\x3f\xca\x3c\x61\xa0",
+        // Hash tables cleared between documents, and a refresher
+        "jk!\x42abjk!\x70\x01jk!\x42cd",
+        "jk!\x82\x71\x82\x11\x12\x42ab\x11",
+        // Documents without a header
+        "\x11jk!\x12\x13",
+        // A swapped array with a missing cell
+        "jk!\xa2\x41a\x82\x11\xa0\x41b\x82\x01\x02",
+        // Other special values and integer sizes
+        "jk!\x8b\x00\x03\x20\x2e\x2f\xa0\x1d\x80\x1c\x80\x00\x1b\x80\x00\x00\x00\x1e\x81\x00\x1f\x81\x80\x00",
+    }
+    for _, stream := range streams {
+        disassemble_assemble(t, []byte(stream))
+    }
+}
+
+func TestDisassembleAssembleRandom(t *testing.T) {
+    random := rand.New(rand.NewSource(1))
+    for i := 0; i < 300; i++ {
+        // Documents of one Encoder share hash tables and delta integers
+        var stream bytes.Buffer
+        encoder := NewEncoder(&stream)
+        for j := random.Intn(4); j >= 0; j-- {
+            if err := encoder.Encode(random_value(random, 0)); err != nil {
+                t.Fatal(err)
+            }
+        }
+        disassemble_assemble(t, stream.Bytes())
+    }
+    long := make([]interface{}, 300)
+    for i := range long {
+        long[i] = map[string]interface{}{ "id": 1000 + i*3, "name": string(make([]byte, i)) }
+    }
+    data, err := Marshal(long)
+    if err != nil {
+        t.Fatal(err)
+    }
+    disassemble_assemble(t, data)
+}
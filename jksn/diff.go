@@ -0,0 +1,390 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "math"
+    "math/big"
+    "strconv"
+)
+
+// PatchOp is one change in a Patch, as in JSON Patch (RFC 6902): "add"
+// inserts Value into an array or sets an object key, "remove" deletes the
+// value at Path, and "replace" overwrites it.
+//
+// JSON Pointers only hold strings, so when the last token of Path names an
+// object key which is not a string, Key holds that key, and "key" is added
+// to the JSON.
+type PatchOp struct {
+    Op      string  `json:"op"`
+    Path    string  `json:"path"`
+    Value   *Value  `json:"value,omitempty"`
+    Key     *Value  `json:"key,omitempty"`
+    // The value removed or replaced, as found by Diff; not part of the JSON
+    Old     *Value  `json:"-"`
+}
+
+// UnmarshalJSON reads a JSON Patch operation, keeping a null value as a
+// null Value rather than none.
+func (self *PatchOp) UnmarshalJSON(data []byte) error {
+    var op struct {
+        Op      string          `json:"op"`
+        Path    string          `json:"path"`
+        Value   json.RawMessage `json:"value"`
+        Key     *Value          `json:"key"`
+    }
+    if err := json.Unmarshal(data, &op); err != nil {
+        return err
+    }
+    *self = PatchOp{ Op: op.Op, Path: op.Path, Key: op.Key }
+    if op.Value != nil {
+        self.Value = new(Value)
+        return self.Value.UnmarshalJSON(op.Value)
+    }
+    return nil
+}
+
+// Patch is a list of changes, applied in order. It marshals to JSON Patch,
+// with values in extended JSON, see Value.ExtendedJSON.
+type Patch []PatchOp
+
+// Diff returns the changes which turn a into b. Values are compared by what
+// they hold, not by how they were encoded: a delta integer equals the
+// integer it stands for, a UTF-16 string the same UTF-8 string, a swapped
+// array the array of objects it holds, and floats of any size are equal if
+// their values are.
+func Diff(a *Value, b *Value) Patch {
+    var result Patch
+    diff_values(&result, nil, nil, a, b)
+    return result
+}
+
+// diff_values compares the values at path, where key is the last object key
+// of path if it is not a string.
+func diff_values(result *Patch, path []string, key *Value, a *Value, b *Value) {
+    switch {
+    case a.Kind() == KindObject && b.Kind() == KindObject: {
+        for _, field := range a.Keys() {
+            if _, ok := b.fields[field]; !ok {
+                *result = append(*result, PatchOp{ "remove", format_pointer(append(path, pointer_token(field))), nil, patch_key(field), a.fields[field] })
+            }
+        }
+        for _, field := range b.Keys() {
+            key_path := append(path[:len(path):len(path)], pointer_token(field))
+            if old, ok := a.fields[field]; ok {
+                diff_values(result, key_path, patch_key(field), old, b.fields[field])
+            } else {
+                *result = append(*result, PatchOp{ "add", format_pointer(key_path), b.fields[field], patch_key(field), nil })
+            }
+        }
+    }
+    case a.Kind() == KindArray && b.Kind() == KindArray:
+        diff_arrays(result, path, a.items, b.items)
+    case !a.Equal(b):
+        *result = append(*result, PatchOp{ "replace", format_pointer(path), b, key, a })
+    }
+}
+
+// patch_key returns the Key of an operation on an object key, which is nil
+// for strings.
+func patch_key(key interface{}) *Value {
+    if _, ok := key.(string); ok {
+        return nil
+    }
+    return key_value(key)
+}
+
+// Steps of an edit script
+const (
+    edit_keep = iota
+    edit_remove
+    edit_add
+)
+
+// diff_arrays finds the shortest edit script between two arrays. Runs of
+// removed items followed by added ones are compared pairwise, so that an
+// item changed in place gives the changes inside it.
+func diff_arrays(result *Patch, path []string, a []*Value, b []*Value) {
+    edits := shortest_edit(len(a), len(b), func(i int, j int) bool {
+        return a[i].Equal(b[j])
+    })
+    index, a_index, b_index := 0, 0, 0
+    item_path := func() []string {
+        return append(path[:len(path):len(path)], strconv.Itoa(index))
+    }
+    for i := 0; i < len(edits); {
+        if edits[i] == edit_keep {
+            index, a_index, b_index, i = index+1, a_index+1, b_index+1, i+1
+            continue
+        }
+        removed, added := 0, 0
+        for ; i < len(edits) && edits[i] == edit_remove; i++ {
+            removed++
+        }
+        for ; i < len(edits) && edits[i] == edit_add; i++ {
+            added++
+        }
+        for ; removed != 0 && added != 0; removed, added = removed-1, added-1 {
+            diff_values(result, item_path(), nil, a[a_index], b[b_index])
+            index, a_index, b_index = index+1, a_index+1, b_index+1
+        }
+        for ; removed != 0; removed-- {
+            *result = append(*result, PatchOp{ "remove", format_pointer(item_path()), nil, nil, a[a_index] })
+            a_index++
+        }
+        for ; added != 0; added-- {
+            *result = append(*result, PatchOp{ "add", format_pointer(item_path()), b[b_index], nil, nil })
+            index, b_index = index+1, b_index+1
+        }
+    }
+}
+
+// shortest_edit returns the steps turning n items into m items with the
+// fewest removals and additions, by the algorithm of Eugene W. Myers, "An
+// O(ND) Difference Algorithm and Its Variations" (1986).
+func shortest_edit(n int, m int, equal func(int, int) bool) []int8 {
+    // Items common to both ends need no search
+    prefix, suffix := 0, 0
+    for prefix < n && prefix < m && equal(prefix, prefix) {
+        prefix++
+    }
+    for suffix < n - prefix && suffix < m - prefix && equal(n-1-suffix, m-1-suffix) {
+        suffix++
+    }
+    middle_n, middle_m := n - prefix - suffix, m - prefix - suffix
+    middle_equal := func(i int, j int) bool {
+        return equal(prefix + i, prefix + j)
+    }
+    // furthest[offset+k] is the furthest x reached on diagonal k = x - y;
+    // one copy is kept per number of edits for backtracking
+    offset := middle_n + middle_m + 1
+    furthest := make([]int, 2 * offset + 1)
+    var history [][]int
+    search:
+    for d := 0; d <= middle_n + middle_m; d++ {
+        history = append(history, append([]int(nil), furthest...))
+        for k := -d; k <= d; k += 2 {
+            var x int
+            if k == -d || (k != d && furthest[offset+k-1] < furthest[offset+k+1]) {
+                x = furthest[offset+k+1]
+            } else {
+                x = furthest[offset+k-1] + 1
+            }
+            y := x - k
+            for x < middle_n && y < middle_m && middle_equal(x, y) {
+                x, y = x+1, y+1
+            }
+            furthest[offset+k] = x
+            if x >= middle_n && y >= middle_m {
+                break search
+            }
+        }
+    }
+    var reversed []int8
+    x, y := middle_n, middle_m
+    for d := len(history) - 1; d > 0; d-- {
+        previous := history[d]
+        k := x - y
+        var previous_k int
+        if k == -d || (k != d && previous[offset+k-1] < previous[offset+k+1]) {
+            previous_k = k + 1
+        } else {
+            previous_k = k - 1
+        }
+        previous_x := previous[offset+previous_k]
+        previous_y := previous_x - previous_k
+        for x > previous_x && y > previous_y {
+            reversed = append(reversed, edit_keep)
+            x, y = x-1, y-1
+        }
+        if x == previous_x {
+            reversed = append(reversed, edit_add)
+        } else {
+            reversed = append(reversed, edit_remove)
+        }
+        x, y = previous_x, previous_y
+    }
+    for ; x > 0 && y > 0; x, y = x-1, y-1 {
+        reversed = append(reversed, edit_keep)
+    }
+    result := make([]int8, 0, prefix + len(reversed) + suffix)
+    for i := 0; i < prefix; i++ {
+        result = append(result, edit_keep)
+    }
+    for i := len(reversed) - 1; i >= 0; i-- {
+        result = append(result, reversed[i])
+    }
+    for i := 0; i < suffix; i++ {
+        result = append(result, edit_keep)
+    }
+    return result
+}
+
+// Equal reports whether two values hold the same data, as Diff compares them.
+// An integer and a float of the same value are equal, since SetIntegralFloats
+// writes one as the other.
+func (self *Value) Equal(other *Value) bool {
+    if self.Kind() != other.Kind() {
+        return is_number(self) && is_number(other) && same_number(self, other)
+    }
+    switch self.Kind() {
+    case KindUndefined, KindNull, KindUnspecified:
+        return true
+    case KindBool:
+        return self.Bool() == other.Bool()
+    case KindInt:
+        return self.BigInt().Cmp(other.BigInt()) == 0
+    case KindFloat:
+        return same_number(self, other)
+    case KindString:
+        return self.Str() == other.Str()
+    case KindBlob:
+        return bytes.Equal(self.Bytes(), other.Bytes())
+    case KindArray: {
+        if len(self.items) != len(other.items) {
+            return false
+        }
+        for i, item := range self.items {
+            if !item.Equal(other.items[i]) {
+                return false
+            }
+        }
+        return true
+    }
+    default: {
+        if len(self.fields) != len(other.fields) {
+            return false
+        }
+        for key, item := range self.fields {
+            if other_item, ok := other.fields[key]; !ok || !item.Equal(other_item) {
+                return false
+            }
+        }
+        return true
+    }
+    }
+}
+
+// same_number compares two integer or float values without rounding.
+func same_number(a *Value, b *Value) bool {
+    a_float, a_nan := number_value(a)
+    b_float, b_nan := number_value(b)
+    if a_nan || b_nan {
+        return a_nan && b_nan
+    }
+    return a_float.Cmp(b_float) == 0
+}
+
+// exact_float converts the scalar of a float Value without rounding.
+func exact_float(scalar interface{}) (result *big.Float, nan bool) {
+    switch scalar.(type) {
+    case float32:
+        return exact_float(float64(scalar.(float32)))
+    case float64:
+        if math.IsNaN(scalar.(float64)) {
+            return nil, true
+        }
+        return big.NewFloat(scalar.(float64)), false
+    case *big.Float:
+        return scalar.(*big.Float), false
+    case json.Number: {
+        result, err := text_to_big_float(string(scalar.(json.Number)), 0)
+        return result, err != nil
+    }
+    default:
+        return nil, true
+    }
+}
+
+// Apply makes the changes of the patch to value, in order. It stops at the
+// first change which does not fit, returning its error; the changes before
+// it remain.
+func (self Patch) Apply(value *Value) error {
+    for i, op := range self {
+        var err error
+        switch {
+        case op.Key != nil:
+            err = value.apply_key(&op)
+        case op.Op == "add":
+            err = value.add_pointer(op.Path, op.Value)
+        case op.Op == "remove":
+            err = value.RemovePointer(op.Path)
+        case op.Op == "replace":
+            if op.Value == nil {
+                err = errors.New("jksn: replace without a value at " + strconv.Quote(op.Path))
+            } else if _, err = value.Pointer(op.Path); err == nil {
+                err = value.SetPointer(op.Path, op.Value)
+            }
+        default:
+            err = errors.New("jksn: unknown patch operation " + strconv.Quote(op.Op))
+        }
+        if err != nil {
+            return errors.New("jksn: patch operation " + strconv.Itoa(i) + ": " + err.Error())
+        }
+    }
+    return nil
+}
+
+// apply_key makes a change to the object key op.Key of the parent of op.Path.
+func (self *Value) apply_key(op *PatchOp) error {
+    parent, _, err := self.pointer_parent(op.Path)
+    if err != nil {
+        return err
+    }
+    switch op.Key.Kind() {
+    case KindUndefined, KindUnspecified, KindBlob, KindArray, KindObject:
+        return errors.New("jksn: object key of kind " + op.Key.Kind().String() + " at " + strconv.Quote(op.Path))
+    }
+    key := normalize_key(op.Key.generic(false))
+    if parent.Kind() != KindObject || (op.Op != "add" && parent.fields[key] == nil) {
+        return errors.New("jksn: JSON pointer " + strconv.Quote(op.Path) + " not found")
+    }
+    switch op.Op {
+    case "add", "replace":
+        if op.Value == nil {
+            return errors.New("jksn: " + op.Op + " without a value at " + strconv.Quote(op.Path))
+        }
+        parent.fields[key] = op.Value
+    case "remove":
+        delete(parent.fields, key)
+    default:
+        return errors.New("jksn: unknown patch operation " + strconv.Quote(op.Op))
+    }
+    return nil
+}
+
+// add_pointer is SetPointer, except that array items are inserted.
+func (self *Value) add_pointer(pointer string, item *Value) error {
+    if item == nil {
+        return errors.New("jksn: add without a value at " + strconv.Quote(pointer))
+    }
+    parent, token, err := self.pointer_parent(pointer)
+    if err == nil && parent.Kind() == KindArray {
+        if index, ok := pointer_index(token, len(parent.items)); ok {
+            parent.Insert(index, item)
+            return nil
+        }
+        return errors.New("jksn: JSON pointer " + strconv.Quote(pointer) + " not found")
+    }
+    return self.SetPointer(pointer, item)
+}
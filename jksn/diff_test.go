@@ -0,0 +1,98 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "encoding/json"
+    "math"
+    "math/rand"
+    "testing"
+)
+
+func TestDiffApply(t *testing.T) {
+    random := rand.New(rand.NewSource(1))
+    for i := 0; i < 3000; i++ {
+        a, b := random_value(random, 0), random_value(random, 0)
+        data, err := json.Marshal(Diff(a, b))
+        if err != nil {
+            t.Fatal(err)
+        }
+        var patch Patch
+        if err := json.Unmarshal(data, &patch); err != nil {
+            t.Fatalf("%s: %v", data, err)
+        }
+        result := copy_value(t, a)
+        if err := patch.Apply(result); err != nil {
+            t.Fatalf("applying %s: %v", data, err)
+        }
+        if !result.Equal(b) {
+            a_text, _ := json.Marshal(a)
+            b_text, _ := json.Marshal(b)
+            result_text, _ := json.Marshal(result)
+            t.Fatalf("patch %s turned %s into %s, not %s", data, a_text, result_text, b_text)
+        }
+    }
+}
+
+func TestDiffIntegerKey(t *testing.T) {
+    a, b := NewObject(), NewObject()
+    a.Set("x", NewBool(true))
+    a.Set("2", NewInt(1))
+    b.Set(int64(2), NewInt(2))
+    b.Set("2", NewInt(1))
+    patch := Diff(a, b)
+    if err := patch.Apply(a); err != nil {
+        t.Fatal(err)
+    }
+    if !a.Equal(b) {
+        t.Fatalf("got %v, want %v", a.Interface(), b.Interface())
+    }
+}
+
+func TestEqualIntegralFloat(t *testing.T) {
+    data := map[string]interface{}{ "count": 3.0, "items": []interface{}{ 1.0, 2.5, -7.0 } }
+    var decoded [2]*Value
+    for i, integral := range []bool{ false, true } {
+        var stream bytes.Buffer
+        encoder := NewEncoder(&stream)
+        encoder.SetIntegralFloats(integral)
+        if err := encoder.Encode(data); err != nil {
+            t.Fatal(err)
+        }
+        decoded[i] = new(Value)
+        if err := Unmarshal(stream.Bytes(), decoded[i]); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if kind := decoded[1].Get("count").Kind(); kind != KindInt {
+        t.Fatalf("integral float written as %v, not as an integer", kind)
+    }
+    if patch := Diff(decoded[0], decoded[1]); len(patch) != 0 {
+        text, _ := json.Marshal(patch)
+        t.Errorf("got patch %s between the same data", text)
+    }
+    if !NewInt(3).Equal(NewFloat(3)) || !NewFloat(-7).Equal(NewInt(-7)) {
+        t.Error("integer and integral float of the same value are not equal")
+    }
+    if NewInt(3).Equal(NewFloat(3.5)) || NewInt(3).Equal(NewFloat(math.NaN())) || NewInt(3).Equal(NewString("3")) {
+        t.Error("integer equal to a different value")
+    }
+}
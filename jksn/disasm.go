@@ -0,0 +1,313 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math"
+    "math/big"
+    "strconv"
+    "strings"
+)
+
+// Disassemble writes an annotated listing of the JKSN stream read from
+// reader. Each line shows the offset and bytes of one control byte with its
+// payload, indented by nesting depth, and what it means in the notation of
+// Assemble, followed by notes such as
+//
+//     0000002a  3c 7a                      ref 0x7a → "user_id"
+//     0000002c  d7                         delta -4 → 1017
+//
+// After each document, the hash table slots it changed and the last integer,
+// which delta integers are relative to, are listed as comments. If the
+// document cleared the hash tables, all of their slots in use are listed.
+func Disassemble(reader io.Reader, writer io.Writer) error {
+    decoder := NewDecoder(reader)
+    listing := &disassembler{ writer: bufio.NewWriter(writer), decoder: decoder }
+    decoder.trace, decoder.capture = listing, new(bytes.Buffer)
+    var err error
+    for document := 0; ; document++ {
+        state := index_state{ decoder.texthash, decoder.blobhash }
+        decoder.traceoffset = decoder.readcount
+        if err = decoder.begin_document(); err != nil {
+            if err == io.EOF {
+                err = nil
+            }
+            break
+        }
+        listing.comment(fmt.Sprintf("document %d", document))
+        if decoder.capture.Len() != 0 {
+            decoder.traced(trace_header, 'j', 0, nil)
+        }
+        decoder.skip_top_value()
+        if err = decoder.result_err(); err != nil {
+            if decoder.capture.Len() != 0 {
+                listing.line(decoder.traceoffset, decoder.capture.Bytes(), decoder.tracedepth, "bytes " + trace_hex(decoder.capture.Bytes()) + " → truncated")
+            }
+            listing.comment("error: " + err.Error())
+            break
+        }
+        listing.state(decoder, state)
+    }
+    if flush_err := listing.writer.Flush(); err == nil {
+        err = flush_err
+    }
+    return err
+}
+
+type disassembler struct {
+    writer  *bufio.Writer
+    decoder *Decoder
+    // Whether the current document cleared the hash tables
+    cleared bool
+}
+
+// tracer is told about every control byte skip_value reads.
+type tracer interface {
+    trace(event *trace_event)
+}
+
+type trace_part int
+
+const (
+    // A control byte and its payload
+    trace_value trace_part = iota
+    trace_header
+    // The checksum after a checksummed value
+    trace_checksum
+    // A byte which is not a control byte
+    trace_invalid
+)
+
+type trace_event struct {
+    offset  int64
+    data    []byte
+    depth   int
+    part    trace_part
+    control uint8
+    // The length of a string, blob, container or refresher
+    length  uint64
+    // The value of an integer or the delta of a delta integer
+    number  *big.Int
+}
+
+// traced describes the bytes read since the previous call to the tracer, if
+// there is one. Bytes of a value which failed to decode are left for the
+// caller to report.
+func (self *Decoder) traced(part trace_part, control uint8, length uint64, number *big.Int) {
+    if self.trace == nil || self.stopped() {
+        return
+    }
+    self.trace.trace(&trace_event{ self.traceoffset, self.capture.Bytes(), self.tracedepth, part, control, length, number })
+    self.capture.Reset()
+    self.traceoffset = self.readcount
+}
+
+// text returns the string of a string event, which skip_value has just put
+// into the hash table.
+func (self *trace_event) text(decoder *Decoder) string {
+    return *decoder.texthash[djb_hash(self.data[header_length(self.data):])]
+}
+
+func (self *disassembler) trace(event *trace_event) {
+    if event.part == trace_value && event.control == 0x70 {
+        self.cleared = true
+    }
+    self.line(event.offset, event.data, event.depth, self.describe(event))
+}
+
+// describe writes an event in the notation of Assemble, with notes.
+func (self *disassembler) describe(event *trace_event) string {
+    control, data, length := event.control, event.data, event.length
+    switch event.part {
+    case trace_header:
+        return "header"
+    case trace_checksum:
+        return "bytes " + trace_hex(data) + " → " + checksum_mnemonic(control) + " checksum"
+    case trace_invalid:
+        return fmt.Sprintf("bytes %02x → %s", control, control_kind(control))
+    }
+    switch control & 0xf0 {
+    case 0x00:
+        if control == 0x0f {
+            return "json"
+        }
+        return [...]string{ "undefined", "null", "false", "true" }[control]
+    case 0x10:
+        return "int" + number_suffix(control, event.number) + " " + event.number.String()
+    case 0x20:
+        switch control {
+        case 0x2b: {
+            var buf [10]byte
+            copy(buf[:], data[1:])
+            return "float80 " + float80_text(buf)
+        }
+        case 0x2c:
+            return fmt.Sprint("float64 ", math.Float64frombits(binary.BigEndian.Uint64(data[1:])))
+        case 0x2d:
+            return fmt.Sprint("float32 ", math.Float32frombits(binary.BigEndian.Uint32(data[1:])))
+        default:
+            return map[uint8]string{ 0x20: "nan", 0x2e: "-inf", 0x2f: "inf" }[control]
+        }
+    case 0x30, 0x40: {
+        if control == 0x3c {
+            return self.describe_reference(control, data[1])
+        }
+        mnemonic := "str" + header_suffix(control, 0, 12, length)
+        if control & 0xf0 == 0x30 {
+            mnemonic = "utf16" + header_suffix(control, 0, 11, length)
+        }
+        hashvalue := djb_hash(data[header_length(data):])
+        return fmt.Sprintf("%s %s → hash 0x%02x", mnemonic, strconv.Quote(event.text(self.decoder)), hashvalue)
+    }
+    case 0x50: {
+        if control == 0x5c {
+            return self.describe_reference(control, data[1])
+        }
+        buf := data[header_length(data):]
+        return fmt.Sprintf("blob%s %s → hash 0x%02x", header_suffix(control, 0, 11, length), trace_hex(buf), djb_hash(buf))
+    }
+    case 0x70:
+        if control == 0x70 {
+            return "clear"
+        }
+        return fmt.Sprintf("refresh%s %d", header_suffix(control, 1, 12, length), length)
+    case 0x80:
+        return fmt.Sprintf("array%s %d", header_suffix(control, 0, 12, length), length)
+    case 0x90:
+        return fmt.Sprintf("object%s %d", header_suffix(control, 0, 12, length), length)
+    case 0xa0:
+        if control == 0xa0 {
+            return "unspecified"
+        }
+        return fmt.Sprintf("swapped%s %d", header_suffix(control, 1, 12, length), length)
+    case 0xc0:
+        if control == 0xc8 {
+            return "lengthless"
+        }
+        return "pad"
+    case 0xd0: {
+        text := "delta" + number_suffix(control, event.number) + " " + event.number.String()
+        if self.decoder.lastint == nil {
+            return text + " → no previous integer"
+        }
+        return text + " → " + self.decoder.lastint.String()
+    }
+    default:
+        switch {
+        case control <= 0xf5:
+            return "checksum " + checksum_mnemonic(control) + " " + trace_hex(data[1:])
+        case control == 0xff:
+            return "pragma"
+        default:
+            return "checked " + checksum_mnemonic(control)
+        }
+    }
+}
+
+func (self *disassembler) describe_reference(control uint8, hashvalue uint8) string {
+    switch {
+    case control == 0x3c && self.decoder.texthash[hashvalue] != nil:
+        return fmt.Sprintf("ref 0x%02x → %s", hashvalue, trace_quote(*self.decoder.texthash[hashvalue]))
+    case control == 0x5c && self.decoder.blobhash[hashvalue] != nil:
+        return fmt.Sprintf("blobref 0x%02x → %d bytes", hashvalue, len(self.decoder.blobhash[hashvalue]))
+    case control == 0x3c:
+        return fmt.Sprintf("ref 0x%02x → missing", hashvalue)
+    default:
+        return fmt.Sprintf("blobref 0x%02x → missing", hashvalue)
+    }
+}
+
+func (self *disassembler) line(offset int64, data []byte, depth int, text string) {
+    hex := trace_hex(data)
+    if len(data) > 8 {
+        hex = trace_hex(data[:8]) + " .."
+    }
+    fmt.Fprintf(self.writer, "%08x  %-26s %s%s\n", offset, hex, strings.Repeat("  ", depth), text)
+}
+
+func (self *disassembler) comment(text string) {
+    fmt.Fprintf(self.writer, "; %s\n", text)
+}
+
+// state lists the hash table slots changed since before and the last integer,
+// or every slot in use if the tables were cleared.
+func (self *disassembler) state(decoder *Decoder, before index_state) {
+    if decoder.lastint != nil {
+        self.comment("lastint " + decoder.lastint.String())
+    }
+    if self.cleared {
+        self.comment("hash tables cleared")
+        before = index_state{}
+    }
+    for i := range decoder.texthash {
+        switch {
+        case decoder.texthash[i] == before.texthash[i]:
+        case decoder.texthash[i] == nil:
+            self.comment(fmt.Sprintf("text hash 0x%02x cleared", i))
+        default:
+            self.comment(fmt.Sprintf("text hash 0x%02x = %s", i, trace_quote(*decoder.texthash[i])))
+        }
+    }
+    for i := range decoder.blobhash {
+        switch {
+        case (decoder.blobhash[i] == nil) == (before.blobhash[i] == nil) && same_bytes(decoder.blobhash[i], before.blobhash[i]):
+        case decoder.blobhash[i] == nil:
+            self.comment(fmt.Sprintf("blob hash 0x%02x cleared", i))
+        default:
+            self.comment(fmt.Sprintf("blob hash 0x%02x = %d bytes", i, len(decoder.blobhash[i])))
+        }
+    }
+    self.cleared = false
+}
+
+// trace_quote quotes a string for a listing, shortening long ones.
+func trace_quote(text string) string {
+    const max_runes = 48
+    runes := []rune(text)
+    if len(runes) > max_runes {
+        return strconv.Quote(string(runes[:max_runes])) + "..."
+    }
+    return strconv.Quote(text)
+}
+
+// trace_hex writes bytes as the operands of the bytes and blob mnemonics.
+func trace_hex(data []byte) string {
+    var result strings.Builder
+    for i, b := range data {
+        if i != 0 {
+            result.WriteByte(' ')
+        }
+        fmt.Fprintf(&result, "%02x", b)
+    }
+    return result.String()
+}
+
+// float80_text formats an 80-bit float precisely enough to assemble it back.
+func float80_text(buf [10]byte) string {
+    if value, ok := float80_to_generic(buf).(*big.Float); ok {
+        return value.Text('g', -1)
+    }
+    return fmt.Sprint(float80_to_generic(buf))
+}
@@ -0,0 +1,339 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "math/big"
+    "strconv"
+    "strings"
+)
+
+// Extended JSON represents the JKSN values which JSON cannot hold as objects
+// with a single key starting with "$jksn_":
+//
+//     blob                    {"$jksn_blob": "aGVsbG8="}, in standard base64
+//     integer beyond ±2^53    {"$jksn_int": "123456789012345678901234567890"}
+//     NaN or infinity         {"$jksn_float": "NaN"}, "Infinity" or "-Infinity"
+//     32-bit float            {"$jksn_float32": "0.1"}
+//     80-bit float            {"$jksn_float80": "3.1415926535897932385"}
+//     JSON number literal     {"$jksn_number": "3.14159265358979323846264338"},
+//     as 0x0f holds for floats of more than 80 bits
+//     undefined               {"$jksn_undefined": null}
+//     unspecified             {"$jksn_unspecified": null}
+//     object whose keys are   {"$jksn_object": [[1, "one"], ["two", 2]]}
+//     not all strings
+//
+// Other floats are written as JSON numbers with a fraction or an exponent,
+// so that they are not read back as integers. An object with a single key
+// starting with "$jksn_" is written in the $jksn_object form, so that it is
+// not mistaken for one of the above. Reading extended JSON back therefore
+// gives the same Value.
+
+const extended_prefix = "$jksn_"
+
+// max_exact_int is the largest magnitude of integers every JSON reader
+// holds exactly, as a double.
+var max_exact_int = big.NewInt(1 << 53)
+
+// ExtendedJSON converts the value to the extended JSON form, made of the
+// types encoding/json decodes into, with numbers as json.Number.
+func (self *Value) ExtendedJSON() interface{} {
+    switch self.Kind() {
+    case KindUndefined:
+        return map[string]interface{}{ "$jksn_undefined": nil }
+    case KindUnspecified:
+        return map[string]interface{}{ "$jksn_unspecified": nil }
+    case KindNull:
+        return nil
+    case KindBool, KindString:
+        return self.scalar
+    case KindInt: {
+        number := self.scalar.(*big.Int)
+        if new(big.Int).Abs(number).Cmp(max_exact_int) > 0 {
+            return map[string]interface{}{ "$jksn_int": number.String() }
+        }
+        return json.Number(number.String())
+    }
+    case KindFloat:
+        return extended_float(self.scalar)
+    case KindBlob:
+        return map[string]interface{}{ "$jksn_blob": base64.StdEncoding.EncodeToString(self.scalar.([]byte)) }
+    case KindArray: {
+        result := make([]interface{}, len(self.items))
+        for i, item := range self.items {
+            result[i] = item.ExtendedJSON()
+        }
+        return result
+    }
+    default: {
+        keys := self.Keys()
+        plain := len(keys) != 1 || !is_extended_key(keys[0])
+        for _, key := range keys {
+            if _, ok := key.(string); !ok {
+                plain = false
+            }
+        }
+        if plain {
+            result := make(map[string]interface{}, len(keys))
+            for _, key := range keys {
+                result[key.(string)] = self.fields[key].ExtendedJSON()
+            }
+            return result
+        }
+        pairs := make([]interface{}, len(keys))
+        for i, key := range keys {
+            pairs[i] = []interface{}{ key_value(key).ExtendedJSON(), self.fields[key].ExtendedJSON() }
+        }
+        return map[string]interface{}{ "$jksn_object": pairs }
+    }
+    }
+}
+
+func is_extended_key(key interface{}) bool {
+    text, ok := key.(string)
+    return ok && strings.HasPrefix(text, extended_prefix)
+}
+
+// key_value turns an object key back into a Value.
+func key_value(key interface{}) *Value {
+    if key_int, ok := key.(int64); ok {
+        return NewInt(key_int)
+    }
+    return value_from_generic(key)
+}
+
+func extended_float(number interface{}) interface{} {
+    switch number.(type) {
+    case float32: {
+        if math.IsNaN(float64(number.(float32))) || math.IsInf(float64(number.(float32)), 0) {
+            return extended_float(float64(number.(float32)))
+        }
+        text := strconv.FormatFloat(float64(number.(float32)), 'g', -1, 32)
+        return map[string]interface{}{ "$jksn_float32": float_text(text) }
+    }
+    case *big.Float: {
+        text := number.(*big.Float).Text('g', -1)
+        return map[string]interface{}{ "$jksn_float80": float_text(text) }
+    }
+    case json.Number:
+        return map[string]interface{}{ "$jksn_number": string(number.(json.Number)) }
+    default: {
+        float := number.(float64)
+        if math.IsNaN(float) || math.IsInf(float, 0) {
+            return map[string]interface{}{ "$jksn_float": float_text(strconv.FormatFloat(float, 'g', -1, 64)) }
+        }
+        data, _ := json.Marshal(float)
+        if !bytes.ContainsAny(data, ".eE") {
+            data = append(data, ".0"...)
+        }
+        return json.Number(data)
+    }
+    }
+}
+
+// float_text spells NaN and infinities as JavaScript does.
+func float_text(text string) string {
+    switch text {
+    case "+Inf":
+        return "Infinity"
+    case "-Inf":
+        return "-Infinity"
+    }
+    return text
+}
+
+// ValueFromExtendedJSON converts a value decoded by encoding/json from
+// extended JSON back into a Value. Numbers should have been decoded as
+// json.Number, so that integers keep their precision.
+func ValueFromExtendedJSON(data interface{}) (*Value, error) {
+    switch data.(type) {
+    case nil:
+        return NewNull(), nil
+    case bool:
+        return NewBool(data.(bool)), nil
+    case string:
+        return NewString(data.(string)), nil
+    case float64:
+        return NewFloat(data.(float64)), nil
+    case json.Number: {
+        text := string(data.(json.Number))
+        if !strings.ContainsAny(text, ".eE") {
+            if number, ok := new(big.Int).SetString(text, 10); ok {
+                return &Value{ kind: KindInt, scalar: number }, nil
+            }
+        }
+        number, err := strconv.ParseFloat(text, 64)
+        if errors.Is(err, strconv.ErrRange) && is_json_number(text) {
+            // Beyond a float64, so keep it as 0x0f would
+            return &Value{ kind: KindFloat, scalar: json.Number(text) }, nil
+        } else if err != nil {
+            return nil, errors.New("jksn: invalid number in extended JSON: " + text)
+        }
+        return NewFloat(number), nil
+    }
+    case []interface{}: {
+        items := data.([]interface{})
+        result := &Value{ kind: KindArray, items: make([]*Value, len(items)) }
+        for i, item := range items {
+            var err error
+            if result.items[i], err = ValueFromExtendedJSON(item); err != nil {
+                return nil, err
+            }
+        }
+        return result, nil
+    }
+    case map[string]interface{}: {
+        fields := data.(map[string]interface{})
+        if len(fields) == 1 {
+            for key, item := range fields {
+                if strings.HasPrefix(key, extended_prefix) {
+                    return extended_special(key, item)
+                }
+            }
+        }
+        result := NewObject()
+        for key, item := range fields {
+            value, err := ValueFromExtendedJSON(item)
+            if err != nil {
+                return nil, err
+            }
+            result.fields[key] = value
+        }
+        return result, nil
+    }
+    default:
+        return nil, fmt.Errorf("jksn: cannot convert extended JSON of Go type %T", data)
+    }
+}
+
+func extended_special(key string, item interface{}) (*Value, error) {
+    invalid := errors.New("jksn: invalid " + key + " in extended JSON")
+    text, is_text := item.(string)
+    switch key {
+    case "$jksn_undefined":
+        return NewUndefined(), nil
+    case "$jksn_unspecified":
+        return NewUnspecified(), nil
+    case "$jksn_blob": {
+        blob, err := base64.StdEncoding.DecodeString(text)
+        if !is_text || err != nil {
+            return nil, invalid
+        }
+        return NewBlob(blob), nil
+    }
+    case "$jksn_int": {
+        number, ok := new(big.Int).SetString(text, 10)
+        if !is_text || !ok {
+            return nil, invalid
+        }
+        return &Value{ kind: KindInt, scalar: number }, nil
+    }
+    case "$jksn_float", "$jksn_float32": {
+        bits := 64
+        if key == "$jksn_float32" {
+            bits = 32
+        }
+        number, err := strconv.ParseFloat(text, bits)
+        if !is_text || (err != nil && !errors.Is(err, strconv.ErrRange)) {
+            return nil, invalid
+        }
+        if bits == 32 {
+            return &Value{ kind: KindFloat, scalar: float32(number) }, nil
+        }
+        return NewFloat(number), nil
+    }
+    case "$jksn_number": {
+        if !is_text || !is_json_number(text) {
+            return nil, invalid
+        }
+        return &Value{ kind: KindFloat, scalar: json.Number(text) }, nil
+    }
+    case "$jksn_float80": {
+        number, _, err := big.ParseFloat(text, 10, 64, big.ToNearestEven)
+        if !is_text || err != nil {
+            // NaN has no *big.Float, and float80_to_generic gives float64
+            if number, err := strconv.ParseFloat(text, 64); is_text && err == nil && math.IsNaN(number) {
+                return NewFloat(number), nil
+            }
+            return nil, invalid
+        }
+        if number.IsInf() {
+            return NewFloat(math.Inf(number.Sign())), nil
+        }
+        return &Value{ kind: KindFloat, scalar: number }, nil
+    }
+    case "$jksn_object": {
+        pairs, ok := item.([]interface{})
+        if !ok {
+            return nil, invalid
+        }
+        result := NewObject()
+        for _, pair := range pairs {
+            pair_items, ok := pair.([]interface{})
+            if !ok || len(pair_items) != 2 {
+                return nil, invalid
+            }
+            key, err := ValueFromExtendedJSON(pair_items[0])
+            if err != nil {
+                return nil, err
+            }
+            switch key.kind {
+            case KindUndefined, KindUnspecified, KindBlob, KindArray, KindObject:
+                return nil, errors.New("jksn: object key of kind " + key.kind.String() + " in extended JSON")
+            }
+            value, err := ValueFromExtendedJSON(pair_items[1])
+            if err != nil {
+                return nil, err
+            }
+            result.fields[normalize_key(key.generic(false))] = value
+        }
+        return result, nil
+    }
+    default:
+        return nil, errors.New("jksn: unknown key " + key + " in extended JSON")
+    }
+}
+
+// MarshalJSON writes the value as extended JSON.
+func (self *Value) MarshalJSON() ([]byte, error) {
+    return json.Marshal(self.ExtendedJSON())
+}
+
+// UnmarshalJSON reads extended JSON into the value.
+func (self *Value) UnmarshalJSON(data []byte) error {
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.UseNumber()
+    var generic_value interface{}
+    if err := decoder.Decode(&generic_value); err != nil {
+        return err
+    }
+    result, err := ValueFromExtendedJSON(generic_value)
+    if err != nil {
+        return err
+    }
+    *self = *result
+    return nil
+}
@@ -0,0 +1,95 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "encoding/json"
+    "math"
+    "math/big"
+    "math/rand"
+    "reflect"
+    "testing"
+)
+
+func TestExtendedJSONRoundTrip(t *testing.T) {
+    huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+    float80, _ := new(big.Float).SetPrec(64).SetString("3.1415926535897932385")
+    mixed := NewObject()
+    mixed.Set(int64(1), NewString("one"))
+    mixed.Set("two", NewInt(2))
+    escaped := NewObject()
+    escaped.Set("$jksn_blob", NewString("not a blob"))
+    values := []*Value{
+        NewUndefined(), NewUnspecified(), NewNull(), NewBool(true), NewInt(-3),
+        NewInt(1 << 53), NewBigInt(huge), NewBigInt(new(big.Int).Neg(huge)),
+        NewFloat(2), NewFloat(0.1), NewFloat(-1e300), NewFloat(math.NaN()), NewFloat(math.Inf(1)), NewFloat(math.Inf(-1)),
+        { kind: KindFloat, scalar: float32(0.1) },
+        { kind: KindFloat, scalar: float80 },
+        { kind: KindFloat, scalar: json.Number("3.14159265358979323846264338") },
+        { kind: KindFloat, scalar: json.Number("1e400") },
+        NewString("$jksn_int"), NewBlob([]byte("hello")), NewBlob([]byte{}),
+        NewArray(NewUndefined(), NewUnspecified(), NewBlob([]byte{ 0, 0xff })),
+        NewObject(), mixed, escaped,
+    }
+    for _, value := range values {
+        data, err := json.Marshal(value)
+        if err != nil {
+            t.Fatal(err)
+        }
+        result := new(Value)
+        if err := json.Unmarshal(data, result); err != nil {
+            t.Fatalf("%s: %v", data, err)
+        }
+        if !result.Equal(value) || reflect.TypeOf(result.scalar) != reflect.TypeOf(value.scalar) {
+            t.Errorf("%s read back as %#v, want %#v", data, result.scalar, value.scalar)
+        }
+    }
+}
+
+func TestExtendedJSONRandom(t *testing.T) {
+    random := rand.New(rand.NewSource(1))
+    for i := 0; i < 1000; i++ {
+        value := random_value(random, 0)
+        data, err := value.MarshalJSON()
+        if err != nil {
+            t.Fatal(err)
+        }
+        result := new(Value)
+        if err := result.UnmarshalJSON(data); err != nil {
+            t.Fatalf("%s: %v", data, err)
+        }
+        if !result.Equal(value) {
+            t.Fatalf("%s read back differently", data)
+        }
+    }
+}
+
+func TestExtendedJSONInvalid(t *testing.T) {
+    for _, data := range []string{
+        `{"$jksn_number": "abc"}`,
+        `{"$jksn_int": "1.5"}`,
+        `{"$jksn_blob": "!!"}`,
+        `{"$jksn_nothing": null}`,
+    } {
+        if err := new(Value).UnmarshalJSON([]byte(data)); err == nil {
+            t.Errorf("%s was accepted", data)
+        }
+    }
+}
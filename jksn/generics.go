@@ -0,0 +1,144 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "io"
+    "iter"
+    "reflect"
+)
+
+// UnmarshalAs decodes a JKSN document into a new value of type T.
+func UnmarshalAs[T any](data []byte) (result T, err error) {
+    err = NewDecoder(bytes.NewReader(data)).Decode(&result)
+    return
+}
+
+// Each decodes a stream of concatenated JKSN documents, yielding values of
+// type T. Unless T is itself a slice or an array, a document holding an
+// array yields its elements one by one, so large top-level arrays are not
+// held in memory at once. Decoding stops after the first error in the stream
+// itself; type mismatches are yielded and decoding continues.
+func Each[T any](reader io.Reader) iter.Seq2[T, error] {
+    return func(yield func(T, error) bool) {
+        decoder := NewDecoder(reader)
+        kind := reflect.TypeFor[T]().Kind()
+        for {
+            var value T
+            err := decoder.begin_document()
+            if err != nil {
+                if err != io.EOF {
+                    yield(value, err)
+                }
+                return
+            }
+            if kind == reflect.Slice || kind == reflect.Array {
+                err = decoder.decode_document(&value)
+                if !yield(value, err) || decoder.fatalerr != nil {
+                    return
+                }
+                continue
+            }
+            control, length, err := decoder.open_array()
+            if err != nil {
+                yield(value, err)
+                return
+            }
+            switch {
+            case control == 0xc8 || control & 0xf0 == 0x80:
+                for i := 0; control == 0xc8 || uint64(i) < length; i++ {
+                    var item T
+                    end, err := decoder.decode_element(&item, i, control == 0xc8)
+                    if end {
+                        break
+                    }
+                    if !yield(item, err) || decoder.fatalerr != nil {
+                        return
+                    }
+                }
+            case control & 0xf0 == 0xa0 && control != 0xa0:
+                var items []T
+                err = decoder.decode_document(&items)
+                if err != nil {
+                    if !yield(value, err) || decoder.fatalerr != nil {
+                        return
+                    }
+                }
+                for _, item := range items {
+                    if !yield(item, nil) {
+                        return
+                    }
+                }
+            default:
+                err = decoder.decode_document(&value)
+                if !yield(value, err) || decoder.fatalerr != nil {
+                    return
+                }
+            }
+        }
+    }
+}
+
+// open_array skips padding and, if the next value is a straight or
+// lengthless array, consumes its header. It returns the control byte of the
+// next value and the array length, if known.
+func (self *Decoder) open_array() (control uint8, length uint64, err error) {
+    control, ok := self.peek_control()
+    if !ok || (control & 0xf0 != 0x80 && control != 0xc8) {
+        return control, 0, nil
+    }
+    return control, self.open_container(control), self.fatalerr
+}
+
+// decode_element decodes the next element of an array opened by open_array.
+// For lengthless arrays, end reports that the terminator was reached.
+func (self *Decoder) decode_element(obj interface{}, index int, lengthless bool) (end bool, err error) {
+    self.firsterr, self.errs = nil, nil
+    self.path = append(self.path[:0], path_index(index))
+    generic_value := self.load_top_value()
+    if _, ok := generic_value.(unspecified); ok && lengthless {
+        return true, self.fatalerr
+    }
+    if !self.stopped() {
+        self.fit_type(reflect.ValueOf(obj), generic_value)
+    }
+    return false, self.result_err()
+}
+
+// Writer encodes values of type T as consecutive JKSN documents. All
+// documents share one Encoder, so later documents may refer to strings and
+// integers from earlier ones and must be read back by a single Decoder.
+type Writer[T any] struct {
+    encoder *Encoder
+}
+
+func NewWriter[T any](writer io.Writer) *Writer[T] {
+    return &Writer[T]{ NewEncoder(writer) }
+}
+
+// Encoder returns the underlying Encoder, so that its options can be set.
+func (self *Writer[T]) Encoder() *Encoder {
+    return self.encoder
+}
+
+func (self *Writer[T]) Write(value T) error {
+    return self.encoder.Encode(value)
+}
@@ -0,0 +1,312 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "math/big"
+    "strconv"
+)
+
+// Index records where the subvalues of a JKSN document start, together with
+// the decoder state needed to decode them on their own, so that a single
+// element of a large document can be read without parsing what precedes it.
+//
+// Offsets are relative to the position of the reader given to BuildIndex,
+// which should be the start of the file for Index.Decode to seek correctly.
+type Index struct {
+    entries     []index_entry
+    lookup      map[string]int
+    base        index_state
+    checkpoints []index_state
+}
+
+type index_entry struct {
+    pointer string
+    key     interface{}
+    offset  int64
+    lastint *big.Int
+    texts   map[uint8]string
+    blobs   map[uint8][]byte
+    // Whether the tables were emptied before the slots in texts and blobs
+    cleared bool
+}
+
+type index_state struct {
+    texthash    [256]*string
+    blobhash    [256][]byte
+}
+
+// Full hash table snapshots are kept in memory every this many entries, so
+// restoring the state of an entry replays a bounded number of updates.
+const index_checkpoint_interval = 1024
+
+const index_file_version = 1
+
+// BuildIndex scans the first document of a stream and records an entry for
+// every array item and object member down to depth levels below the root.
+// Entries are named by JSON Pointers (RFC 6901), such as "/users/3".
+// Row-col swapped arrays are indexed as a whole, as their rows are not
+// stored one after another.
+func BuildIndex(reader io.Reader, depth int) (*Index, error) {
+    builder := &index_builder{ decoder: NewDecoder(reader), result: &Index{ lookup: make(map[string]int) } }
+    if err := builder.decoder.begin_document(); err != nil {
+        return nil, err
+    }
+    builder.walk("", depth)
+    if err := builder.decoder.result_err(); err != nil {
+        return nil, err
+    }
+    builder.result.build_checkpoints()
+    return builder.result, nil
+}
+
+type index_builder struct {
+    decoder     *Decoder
+    result      *Index
+    state       index_state
+}
+
+func (self *index_builder) walk(pointer string, depth int) {
+    decoder := self.decoder
+    control, ok := decoder.peek_control()
+    if !ok || depth <= 0 || !is_container(control) {
+        decoder.skip_top_value()
+        return
+    }
+    length := decoder.open_container(control)
+    switch {
+    case control == 0xc8:
+        for i := 0; !decoder.stopped(); i++ {
+            control, ok := decoder.peek_control()
+            if !ok {
+                decoder.skip_top_value()
+                return
+            }
+            if control == 0xa0 {
+                decoder.read_byte()
+                return
+            }
+            child := pointer + "/" + strconv.Itoa(i)
+            self.record(child, nil)
+            self.walk(child, depth-1)
+        }
+    case control & 0xf0 == 0x80:
+        for i := uint64(0); i < length && !decoder.stopped(); i++ {
+            child := pointer + "/" + strconv.FormatUint(i, 10)
+            self.record(child, nil)
+            self.walk(child, depth-1)
+        }
+    default:
+        for i := uint64(0); i < length && !decoder.stopped(); i++ {
+            key, _ := decoder.hashable_key(decoder.load_top_value())
+            child := pointer + format_pointer([]string{ pointer_token(key) })
+            self.record(child, key)
+            self.walk(child, depth-1)
+        }
+    }
+}
+
+// record adds an entry at the current position, storing the hash table slots
+// changed since the previous entry. key is the object key, if any.
+func (self *index_builder) record(pointer string, key interface{}) {
+    decoder := self.decoder
+    entry := index_entry{ pointer: pointer, key: key, offset: decoder.readcount }
+    if decoder.lastint != nil {
+        entry.lastint = new(big.Int).Set(decoder.lastint)
+    }
+    // A 0x70 refresher empties the tables, and then the entry holds every
+    // slot in use rather than the changes
+    for i := range decoder.texthash {
+        if (decoder.texthash[i] == nil && self.state.texthash[i] != nil) || (decoder.blobhash[i] == nil && self.state.blobhash[i] != nil) {
+            entry.cleared = true
+            self.state = index_state{}
+            break
+        }
+    }
+    for i := range decoder.texthash {
+        if decoder.texthash[i] != self.state.texthash[i] {
+            if entry.texts == nil {
+                entry.texts = make(map[uint8]string)
+            }
+            entry.texts[uint8(i)] = *decoder.texthash[i]
+        }
+        if decoder.blobhash[i] != nil && !same_bytes(decoder.blobhash[i], self.state.blobhash[i]) {
+            if entry.blobs == nil {
+                entry.blobs = make(map[uint8][]byte)
+            }
+            entry.blobs[uint8(i)] = decoder.blobhash[i]
+        }
+    }
+    self.state.texthash, self.state.blobhash = decoder.texthash, decoder.blobhash
+    self.result.lookup[pointer] = len(self.result.entries)
+    self.result.entries = append(self.result.entries, entry)
+}
+
+// same_bytes reports whether a and b are the same slice, not just equal.
+func same_bytes(a, b []byte) bool {
+    return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// pointer_token names an object key in a JSON Pointer.
+func pointer_token(key interface{}) string {
+    switch key.(type) {
+    case string:
+        return key.(string)
+    case *big.Int:
+        return key.(*big.Int).String()
+    default:
+        return fmt.Sprint(key)
+    }
+}
+
+func (self *Index) build_checkpoints() {
+    self.checkpoints = self.checkpoints[:0]
+    state := self.base
+    for i := range self.entries {
+        self.entries[i].apply(&state)
+        if i % index_checkpoint_interval == 0 {
+            self.checkpoints = append(self.checkpoints, state)
+        }
+    }
+}
+
+func (self *index_entry) apply(state *index_state) {
+    if self.cleared {
+        *state = index_state{}
+    }
+    for slot, text := range self.texts {
+        state.texthash[slot] = &text
+    }
+    for slot, blob := range self.blobs {
+        state.blobhash[slot] = blob
+    }
+}
+
+// state returns the decoder state at the start of entry i.
+func (self *Index) state(i int) index_state {
+    checkpoint := i / index_checkpoint_interval
+    state := self.checkpoints[checkpoint]
+    for j := checkpoint * index_checkpoint_interval + 1; j <= i; j++ {
+        self.entries[j].apply(&state)
+    }
+    return state
+}
+
+func (self *Index) Len() int {
+    return len(self.entries)
+}
+
+// Pointers returns the JSON Pointers of all entries in stream order.
+func (self *Index) Pointers() []string {
+    result := make([]string, len(self.entries))
+    for i := range self.entries {
+        result[i] = self.entries[i].pointer
+    }
+    return result
+}
+
+// Offset returns the stream offset at which the value at pointer starts.
+func (self *Index) Offset(pointer string) (int64, bool) {
+    i, ok := self.lookup[pointer]
+    if !ok {
+        return 0, false
+    }
+    return self.entries[i].offset, true
+}
+
+// Decode seeks reader to the value at pointer and decodes it into obj.
+func (self *Index) Decode(reader io.ReadSeeker, pointer string, obj interface{}) error {
+    decoder, err := self.decoder(reader, pointer)
+    if err != nil {
+        return err
+    }
+    return decoder.decode_document(obj)
+}
+
+// decoder returns a Decoder positioned at the value at pointer, with the hash
+// tables and last integer restored.
+func (self *Index) decoder(reader io.ReadSeeker, pointer string) (*Decoder, error) {
+    i, ok := self.lookup[pointer]
+    if !ok {
+        return nil, errors.New("jksn: index has no entry for " + strconv.Quote(pointer))
+    }
+    entry := &self.entries[i]
+    if _, err := reader.Seek(entry.offset, io.SeekStart); err != nil {
+        return nil, err
+    }
+    state := self.state(i)
+    decoder := NewDecoder(reader)
+    decoder.readcount = entry.offset
+    decoder.texthash, decoder.blobhash = state.texthash, state.blobhash
+    if entry.lastint != nil {
+        decoder.lastint = new(big.Int).Set(entry.lastint)
+    }
+    return decoder, nil
+}
+
+type index_file struct {
+    Version int                 `jksn:"version"`
+    Entries []index_file_entry  `jksn:"entries"`
+}
+
+type index_file_entry struct {
+    Pointer string              `jksn:"p"`
+    Offset  int64               `jksn:"o"`
+    Lastint *big.Int            `jksn:"i,omitempty"`
+    Texts   map[uint8]string    `jksn:"t,omitempty"`
+    Blobs   map[uint8][]byte    `jksn:"b,omitempty"`
+    Cleared bool                `jksn:"c,omitempty"`
+}
+
+// WriteTo saves the index, itself encoded as JKSN, for example to a sidecar
+// file next to the indexed document.
+func (self *Index) WriteTo(writer io.Writer) (int64, error) {
+    file := index_file{ index_file_version, make([]index_file_entry, len(self.entries)) }
+    for i, entry := range self.entries {
+        file.Entries[i] = index_file_entry{ entry.pointer, entry.offset, entry.lastint, entry.texts, entry.blobs, entry.cleared }
+    }
+    data, err := Marshal(file)
+    if err != nil {
+        return 0, err
+    }
+    n, err := writer.Write(data)
+    return int64(n), err
+}
+
+// ReadIndex loads an index saved by WriteTo.
+func ReadIndex(reader io.Reader) (*Index, error) {
+    var file index_file
+    if err := NewDecoder(reader).Decode(&file); err != nil {
+        return nil, err
+    }
+    if file.Version != index_file_version {
+        return nil, errors.New("jksn: unsupported index version " + strconv.Itoa(file.Version))
+    }
+    result := &Index{ entries: make([]index_entry, len(file.Entries)), lookup: make(map[string]int, len(file.Entries)) }
+    for i, entry := range file.Entries {
+        result.entries[i] = index_entry{ entry.Pointer, nil, entry.Offset, entry.Lastint, entry.Texts, entry.Blobs, entry.Cleared }
+        result.lookup[entry.Pointer] = i
+    }
+    result.build_checkpoints()
+    return result, nil
+}
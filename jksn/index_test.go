@@ -0,0 +1,111 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+ 
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+ 
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+)
+
+// index_stream makes a lengthless array of rows which refer to the strings,
+// blobs and integers of earlier rows, with the hash tables cleared by 0x70
+// refreshers every so often.
+func index_stream(t *testing.T) []byte {
+    var stream bytes.Buffer
+    encoder := NewEncoder(&stream)
+    if err := encoder.BeginArray(); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 1200; i++ {
+        if i % 300 == 299 {
+            encoder.Reset()
+            stream.WriteByte(0x70)
+        }
+        row := map[string]interface{}{
+            "name": fmt.Sprintf("user%d", i % 50),
+            "id": 1000 + i * 3,
+            "tags": []string{ fmt.Sprintf("tag%d", i % 7), "common" },
+            "blob": []byte(fmt.Sprintf("blob%d", i % 5)),
+        }
+        if err := encoder.EncodeElement(row); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := encoder.EndArray(); err != nil {
+        t.Fatal(err)
+    }
+    return stream.Bytes()
+}
+
+// check_index decodes every entry of index and compares it with the value
+// at its pointer in document.
+func check_index(t *testing.T, index *Index, stream []byte, document *Value) {
+    for _, pointer := range index.Pointers() {
+        expected, err := document.Pointer(pointer)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var value Value
+        if err := index.Decode(bytes.NewReader(stream), pointer, &value); err != nil {
+            t.Fatalf("%s: %v", pointer, err)
+        }
+        if !value.Equal(expected) {
+            t.Fatalf("%s: got %v, want %v", pointer, value.Interface(), expected.Interface())
+        }
+    }
+}
+
+func TestIndex(t *testing.T) {
+    stream := index_stream(t)
+    var document Value
+    if err := Unmarshal(stream, &document); err != nil {
+        t.Fatal(err)
+    }
+    index, err := BuildIndex(bytes.NewReader(stream), 3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Each row has 7 entries: itself, its 4 members and the 2 tags, also
+    // after a refresher
+    if index.Len() != 1200 * 7 || index.Len() < 4 * index_checkpoint_interval {
+        t.Fatalf("%d entries", index.Len())
+    }
+    check_index(t, index, stream, &document)
+
+    var file bytes.Buffer
+    if _, err := index.WriteTo(&file); err != nil {
+        t.Fatal(err)
+    }
+    loaded, err := ReadIndex(&file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if fmt.Sprint(loaded.Pointers()) != fmt.Sprint(index.Pointers()) {
+        t.Fatal("loaded index has other pointers")
+    }
+    for _, pointer := range index.Pointers() {
+        offset, _ := index.Offset(pointer)
+        if loaded_offset, ok := loaded.Offset(pointer); !ok || loaded_offset != offset {
+            t.Fatalf("%s: loaded offset %d, want %d", pointer, loaded_offset, offset)
+        }
+    }
+    check_index(t, loaded, stream, &document)
+}
@@ -29,6 +29,7 @@ import (
     "math"
     "math/big"
     "reflect"
+    "slices"
     "strconv"
     "strings"
     "unicode/utf16"
@@ -54,20 +55,71 @@ func (self *UnsupportedValueError) Error() string {
 type SyntaxError struct {
     msg     string
     Offset  int64
+    Err     error
 }
 
 func (self *SyntaxError) Error() string {
     return self.msg
 }
 
+func (self *SyntaxError) Unwrap() error {
+    return self.Err
+}
+
+type ReadError struct {
+    Offset  int64
+    Err     error
+}
+
+func (self *ReadError) Error() string {
+    return "jksn: read error at offset " + strconv.FormatInt(self.Offset, 10) + ": " + self.Err.Error()
+}
+
+func (self *ReadError) Unwrap() error {
+    return self.Err
+}
+
+// MultiError is returned by a lenient Decoder and lists every recoverable
+// error found in one document, in stream order.
+type MultiError []error
+
+func (self MultiError) Error() string {
+    if len(self) == 1 {
+        return self[0].Error()
+    }
+    messages := make([]string, len(self))
+    for i, err := range self {
+        messages[i] = err.Error()
+    }
+    return strconv.Itoa(len(self)) + " errors: " + strings.Join(messages, "; ")
+}
+
+func (self MultiError) Unwrap() []error {
+    return self
+}
+
 type UnmarshalTypeError struct {
-    Value   string
+    Value   string          // JKSN type name, e.g. "utf8 string"
     Type    reflect.Type
     Offset  int64
+    Path    string          // Location in the document, e.g. "$.users[3].email"
+    Err     error
 }
 
 func (self *UnmarshalTypeError) Error() string {
-    return "jksn: cannot unmarshal " + self.Value + " into Go value of type " + self.Type.String()
+    result := "jksn: cannot unmarshal " + self.Value + " into Go value of type " + self.Type.String()
+    if self.Path != "" {
+        result += " at " + self.Path
+    }
+    result += " (offset " + strconv.FormatInt(self.Offset, 10) + ")"
+    if self.Err != nil {
+        result += ": " + self.Err.Error()
+    }
+    return result
+}
+
+func (self *UnmarshalTypeError) Unwrap() error {
+    return self.Err
 }
 
 type UnmarshalFieldError struct {
@@ -80,6 +132,28 @@ func (self *UnmarshalFieldError) Error() string {
     return "jksn: cannot unmarshal object key " + strconv.Quote(self.Key) + " into unexported field " + self.Field.Name + " of type " + self.Type.String()
 }
 
+type UnknownFieldError struct {
+    Key     string
+    Type    reflect.Type
+    Path    string
+    Offset  int64
+}
+
+func (self *UnknownFieldError) Error() string {
+    return "jksn: unknown field " + strconv.Quote(self.Key) + " for Go value of type " + self.Type.String() + " at " + self.Path + " (offset " + strconv.FormatInt(self.Offset, 10) + ")"
+}
+
+type MissingFieldError struct {
+    Key     string
+    Type    reflect.Type
+    Path    string
+    Offset  int64
+}
+
+func (self *MissingFieldError) Error() string {
+    return "jksn: missing required field " + strconv.Quote(self.Key) + " for Go value of type " + self.Type.String() + " at " + self.Path + " (offset " + strconv.FormatInt(self.Offset, 10) + ")"
+}
+
 type InvalidUnmarshalError struct {
     Type    reflect.Type
 }
@@ -165,12 +239,42 @@ type unspecified struct {}
 
 var unspecified_value = unspecified{}
 
+// ComplexFormat selects how complex numbers are represented in a JKSN stream.
+type ComplexFormat int
+
+const (
+    // Complex numbers are reported as UnsupportedTypeError
+    ComplexUnsupported ComplexFormat = iota
+    // Two-element array [real, imag]
+    ComplexArray
+    // Object {"re": real, "im": imag}
+    ComplexObject
+)
+
 type Encoder struct {
     writer      io.Writer
     firsterr    error
     lastint     *big.Int
     texthash    [256][]byte
     blobhash    [256][]byte
+    timeformat  TimeFormat
+    compactfloats   bool
+    integralfloats  bool
+    complexformat   ComplexFormat
+    strict      bool
+    maxdepth    int
+    maxbuffer   int
+    typetagstyle    TypeTagStyle
+    typetagkey  string
+    depth       int
+    path        []string
+    visiting    map[visit_key]bool
+}
+
+type visit_key struct {
+    ptr     uintptr
+    typ     reflect.Type
+    len     int
 }
 
 func NewEncoder(writer io.Writer) (res *Encoder) {
@@ -179,10 +283,66 @@ func NewEncoder(writer io.Writer) (res *Encoder) {
     return
 }
 
+// SetMaxDepth limits how deeply nested a value may be. Zero means no limit.
+func (self *Encoder) SetMaxDepth(depth int) {
+    self.maxdepth = depth
+}
+
+// SetMaxBuffer limits how many bytes EncodeJSON may hold in memory for
+// objects, which are written only once their keys are counted. Zero means no
+// limit.
+func (self *Encoder) SetMaxBuffer(size int) {
+    self.maxbuffer = size
+}
+
+func (self *Encoder) SetComplexFormat(format ComplexFormat) {
+    self.complexformat = format
+}
+
+// SetStrict causes Encode to write nothing and return the error when any
+// part of the value cannot be encoded, instead of writing null in its place.
+func (self *Encoder) SetStrict(on bool) {
+    self.strict = on
+}
+
 func (self *Encoder) Encode(obj interface{}) (err error) {
+    return self.encode_value(obj, []byte("jk!"))
+}
+
+// BeginArray starts a document holding a lengthless array. Its elements are
+// then written one at a time with EncodeElement, and EndArray ends it, so
+// that the array never has to be held in memory at once.
+func (self *Encoder) BeginArray() error {
+    _, err := self.writer.Write([]byte{ 'j', 'k', '!', 0xc8 })
+    return err
+}
+
+func (self *Encoder) EncodeElement(obj interface{}) error {
+    return self.encode_value(obj, nil)
+}
+
+func (self *Encoder) EndArray() error {
+    _, err := self.writer.Write([]byte{ 0xa0 })
+    return err
+}
+
+// Reset forgets the strings, blobs and integers written so far, so that
+// later values do not refer to them and documents can be decoded on their
+// own, at the cost of a larger output.
+func (self *Encoder) Reset() {
+    self.lastint, self.texthash, self.blobhash = nil, [256][]byte{}, [256][]byte{}
+}
+
+// encode_value writes obj after prefix.
+func (self *Encoder) encode_value(obj interface{}, prefix []byte) (err error) {
     self.firsterr = nil
-    result := self.dump_to_proxy(obj)
-    _, err = self.writer.Write([]byte("jk!"))
+    self.depth, self.path, self.visiting = 0, self.path[:0], make(map[visit_key]bool)
+    result := self.dump_value(obj)
+    if self.strict && self.firsterr != nil {
+        return self.firsterr
+    }
+    result = self.optimize(result)
+    _, err = self.writer.Write(prefix)
     if err == nil {
         err = result.Output(self.writer, true)
     }
@@ -197,11 +357,38 @@ func (self *Encoder) dump_to_proxy(obj interface{}) *jksn_proxy {
 }
 
 func (self *Encoder) dump_value(obj interface{}) *jksn_proxy {
+    if self.strict && self.firsterr != nil {
+        return self.dump_nil(nil)
+    }
+    self.depth++
+    defer func() { self.depth-- }()
+    if self.maxdepth != 0 && self.depth > self.maxdepth {
+        self.store_err(&UnsupportedValueError{ reflect.ValueOf(obj), "maximum nesting depth exceeded at " + path_string(self.path) })
+        return self.dump_nil(nil)
+    }
     if obj == nil {
         return self.dump_nil(nil)
     } else {
         value := reflect.ValueOf(obj)
-        for value.Kind() == reflect.Ptr {
+        for {
+            switch value.Kind() {
+            case reflect.Ptr, reflect.Map, reflect.Slice:
+                if !value.IsNil() {
+                    key := visit_key{ value.Pointer(), value.Type(), 0 }
+                    if value.Kind() == reflect.Slice {
+                        key.len = value.Len()
+                    }
+                    if self.visiting[key] {
+                        self.store_err(&UnsupportedValueError{ value, "encountered a cycle via " + path_string(self.path) })
+                        return self.dump_nil(nil)
+                    }
+                    self.visiting[key] = true
+                    defer delete(self.visiting, key)
+                }
+            }
+            if value.Kind() != reflect.Ptr {
+                break
+            }
             if value.IsNil() {
                 return self.dump_nil(nil)
             } else {
@@ -209,6 +396,9 @@ func (self *Encoder) dump_value(obj interface{}) *jksn_proxy {
                 obj = value.Interface()
             }
         }
+        if result, ok := self.dump_std(obj); ok {
+            return result
+        }
         switch value.Kind() {
         case reflect.Bool:
             return self.dump_bool(obj.(bool))
@@ -224,19 +414,25 @@ func (self *Encoder) dump_value(obj interface{}) *jksn_proxy {
             return self.dump_int(value_big)
         }
         case reflect.Float32:
-            return self.dump_float32(obj.(float32))
+            return self.dump_float32(float32(value.Float()))
         case reflect.Float64:
-            return self.dump_float64(obj.(float64))
+            return self.dump_float64(value.Float())
+        case reflect.Complex64, reflect.Complex128:
+            return self.dump_complex(value)
         case reflect.String:
             return self.dump_string(obj.(string))
         case reflect.Array, reflect.Slice:
-            switch obj.(type) {
-            case []byte:
-                return self.dump_bytes(obj.([]byte))
+            switch {
+            case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8:
+                return self.dump_bytes(value.Bytes())
+            case value.Kind() == reflect.Array && value.Type().Elem().Kind() == reflect.Uint8:
+                obj_bytes := make([]byte, value.Len())
+                reflect.Copy(reflect.ValueOf(obj_bytes), value)
+                return self.dump_bytes(obj_bytes)
             default:
                 obj_array := make([]interface{}, value.Len())
                 for i := 0; i < value.Len(); i++ {
-                    obj_array[i] = value.Index(i).Interface()
+                    obj_array[i] = self.element_interface(value.Index(i))
                 }
                 return self.dump_slice(obj_array)
             }
@@ -244,7 +440,7 @@ func (self *Encoder) dump_value(obj interface{}) *jksn_proxy {
             obj_keys := value.MapKeys()
             obj_map := make(map[interface{}]interface{}, len(obj_keys))
             for _, key := range obj_keys {
-                obj_map[key.Interface()] = value.MapIndex(key).Interface()
+                obj_map[key.Interface()] = self.element_interface(value.MapIndex(key))
             }
             return self.dump_map(obj_map)
         }
@@ -252,6 +448,14 @@ func (self *Encoder) dump_value(obj interface{}) *jksn_proxy {
             switch obj.(type) {
             case unspecified:
                 return self.dump_unspecified(obj.(unspecified))
+            case undefined:
+                return new_jksn_proxy(obj, 0x00, empty_bytes, empty_bytes)
+            case Value: {
+                obj_tree := obj.(Value)
+                return self.dump_value(obj_tree.generic(true))
+            }
+            case float80:
+                return self.dump_float80(obj.(float80).value)
             case big.Int: {
                 obj_bigint := obj.(big.Int)
                 return self.dump_int(&obj_bigint)
@@ -314,11 +518,14 @@ func (self *Encoder) dump_float32(obj float32) *jksn_proxy {
         if buf.Len() != 4 {
             panic("jksn: buf.Len() != 4")
         }
-        return new_jksn_proxy(obj, 0x2d, buf.Bytes(), empty_bytes)
+        return self.shrink_float(new_jksn_proxy(obj, 0x2d, buf.Bytes(), empty_bytes), obj_float64)
     }
 }
 
 func (self *Encoder) dump_float64(obj float64) *jksn_proxy {
+    if self.compactfloats && float64(float32(obj)) == obj {
+        return self.dump_float32(float32(obj))
+    }
     if math.IsNaN(obj) {
         return new_jksn_proxy(obj, 0x20, empty_bytes, empty_bytes)
     } else if math.IsInf(obj, 1) {
@@ -331,8 +538,47 @@ func (self *Encoder) dump_float64(obj float64) *jksn_proxy {
         if buf.Len() != 8 {
             panic("jksn: buf.Len() != 8")
         }
-        return new_jksn_proxy(obj, 0x2c, buf.Bytes(), empty_bytes)
+        return self.shrink_float(new_jksn_proxy(obj, 0x2c, buf.Bytes(), empty_bytes), obj)
+    }
+}
+
+// dump_float80 writes a *big.Float as an 80-bit float if that holds it
+// exactly, or else as big.Float values are normally written.
+func (self *Encoder) dump_float80(obj *big.Float) *jksn_proxy {
+    buf := big_float_to_float80(obj)
+    if exact, ok := float80_to_generic(buf).(*big.Float); ok && exact.Cmp(obj) == 0 && exact.Signbit() == obj.Signbit() {
+        return new_jksn_proxy(obj, 0x2b, buf[:], empty_bytes)
     }
+    return self.dump_value(*obj)
+}
+
+func (self *Encoder) dump_complex(obj reflect.Value) *jksn_proxy {
+    var re, im interface{}
+    if obj.Kind() == reflect.Complex64 {
+        re, im = float32(real(obj.Complex())), float32(imag(obj.Complex()))
+    } else {
+        re, im = real(obj.Complex()), imag(obj.Complex())
+    }
+    switch self.complexformat {
+    case ComplexArray:
+        return self.dump_slice([]interface{}{ re, im })
+    case ComplexObject:
+        return self.dump_map(map[interface{}]interface{}{ "re": re, "im": im })
+    default:
+        self.store_err(&UnsupportedTypeError{ obj.Type() })
+        return self.dump_nil(nil)
+    }
+}
+
+func (self *Encoder) shrink_float(result *jksn_proxy, obj float64) *jksn_proxy {
+    if self.integralfloats && obj == math.Trunc(obj) && !(obj == 0 && math.Signbit(obj)) {
+        obj_int, _ := big.NewFloat(obj).Int(nil)
+        result_int := self.dump_int(obj_int)
+        if result_int.Len(0) < result.Len(0) {
+            return result_int
+        }
+    }
+    return result
 }
 
 func (self *Encoder) dump_string(obj string) (result *jksn_proxy) {
@@ -401,20 +647,18 @@ func (self *Encoder) test_swap_availability(obj []interface{}) (columns bool, as
             row_keys := value.MapKeys()
             as_map[i] = make(map[interface{}]interface{}, len(row_keys))
             for _, key := range row_keys {
-                as_map[i][key.Interface()] = value.MapIndex(key).Interface()
+                as_map[i][key.Interface()] = self.element_interface(value.MapIndex(key))
             }
             if value.Len() != 0 {
                 columns = true
             }
         case reflect.Struct:
-            switch row.(type) {
-            case big.Int:
+            if is_struct_scalar(row) {
                 return false, nil
-            default:
-                as_map[i] = self.struct_to_map(row)
-                if len(as_map[i]) != 0 {
-                    columns = true
-                }
+            }
+            as_map[i] = self.struct_to_map(row)
+            if len(as_map[i]) != 0 {
+                columns = true
             }
         default:
             return false, nil
@@ -436,7 +680,9 @@ func (self *Encoder) encode_straight_slice(obj []interface{}) (result *jksn_prox
     }
     result.Children = make([]*jksn_proxy, length)
     for i := 0; i < length; i++ {
+        self.path = append(self.path, path_index(i))
         result.Children[i] = self.dump_value(obj[i])
+        self.path = self.path[:len(self.path)-1]
     }
     return
 }
@@ -469,7 +715,9 @@ func (self *Encoder) encode_swapped_slice(obj []map[interface{}]interface{}) (re
                 columns_value[i] = unspecified_value
             }
         }
+        self.path = append(self.path, path_key(column))
         result.Children = append(result.Children, self.dump_slice(columns_value))
+        self.path = self.path[:len(self.path)-1]
     }
     return
 }
@@ -487,7 +735,9 @@ func (self *Encoder) dump_map(obj map[interface{}]interface{}) (result *jksn_pro
     }
     result.Children = make([]*jksn_proxy, 0, length*2)
     for key, value := range obj {
+        self.path = append(self.path, path_key(key))
         result.Children = append(result.Children, self.dump_value(key), self.dump_value(value))
+        self.path = self.path[:len(self.path)-1]
     }
     if len(result.Children) != length*2 {
         panic("jksn: len(result.Children) != length*2")
@@ -501,20 +751,69 @@ func (self *Encoder) struct_to_map(obj interface{}) (result map[interface{}]inte
     result = make(map[interface{}]interface{})
     for field := 0; field < obj_type.NumField(); field++ {
         field_type := obj_type.Field(field)
-        tag_name := field_type.Tag.Get("jksn")
-        if len(tag_name) == 0 {
-            tag_name = field_type.Tag.Get("json")
-            if len(tag_name) == 0 {
-                tag_name = field_type.Name
-            }
+        tag_name, tag_options, ok := parse_field_tag(field_type)
+        if !ok {
+            continue
         }
-        if len(tag_name) != 0 && tag_name != "-" {
-            result[tag_name] = obj_value.Field(field).Interface()
+        if tag_options.has("omitempty") && is_empty_value(obj_value.Field(field)) {
+            continue
         }
+        result[tag_name] = self.element_interface(obj_value.Field(field))
     }
     return
 }
 
+type tag_options []string
+
+func (self tag_options) has(option string) bool {
+    for _, i := range self {
+        if i == option {
+            return true
+        }
+    }
+    return false
+}
+
+// parse_field_tag returns the object key of a struct field, taken from the
+// "jksn" tag, then the "json" tag, then the field name, followed by the
+// comma-separated tag options.
+func parse_field_tag(field reflect.StructField) (name string, options tag_options, ok bool) {
+    if field.PkgPath != "" {
+        return "", nil, false
+    }
+    tag, has_tag := field.Tag.Lookup("jksn")
+    if !has_tag {
+        tag, has_tag = field.Tag.Lookup("json")
+    }
+    if tag == "-" {
+        return "", nil, false
+    }
+    parts := strings.Split(tag, ",")
+    name, options = parts[0], tag_options(parts[1:])
+    if len(name) == 0 {
+        name = field.Name
+    }
+    return name, options, true
+}
+
+func is_empty_value(value reflect.Value) bool {
+    switch value.Kind() {
+    case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+        return value.Len() == 0
+    case reflect.Bool:
+        return !value.Bool()
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return value.Int() == 0
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        return value.Uint() == 0
+    case reflect.Float32, reflect.Float64:
+        return value.Float() == 0
+    case reflect.Interface, reflect.Ptr:
+        return value.IsNil()
+    }
+    return false
+}
+
 func (self *Encoder) optimize(obj *jksn_proxy) *jksn_proxy {
     control := obj.Control & 0xf0
     if control == 0x10 {
@@ -548,21 +847,19 @@ func (self *Encoder) optimize(obj *jksn_proxy) *jksn_proxy {
         }
         self.lastint = obj.Origin.(*big.Int)
     } else if control == 0x30 || control == 0x40 {
-        if len(obj.Buf) > 1 {
-            if bytes.Equal(self.texthash[obj.Hash], obj.Buf) {
-                obj.Control, obj.Data, obj.Buf = 0x3c, []byte{ obj.Hash }, empty_bytes
-            } else {
-                self.texthash[obj.Hash] = obj.Buf
-            }
+        // Decoders remember every string, so short ones must replace the
+        // hash table entry too, even though they are never referred to
+        if len(obj.Buf) > 1 && bytes.Equal(self.texthash[obj.Hash], obj.Buf) {
+            obj.Control, obj.Data, obj.Buf = 0x3c, []byte{ obj.Hash }, empty_bytes
+        } else {
+            self.texthash[obj.Hash] = obj.Buf
         }
     } else if control == 0x50 {
-        if len(obj.Buf) > 1 {
-            if bytes.Equal(self.blobhash[obj.Hash], obj.Buf) {
-                obj.Control, obj.Data, obj.Buf = 0x5c, []byte{ obj.Hash }, empty_bytes
-            } else {
-                self.blobhash[obj.Hash] = make([]byte, len(obj.Buf))
-                copy(self.blobhash[obj.Hash], obj.Buf)
-            }
+        if len(obj.Buf) > 1 && bytes.Equal(self.blobhash[obj.Hash], obj.Buf) {
+            obj.Control, obj.Data, obj.Buf = 0x5c, []byte{ obj.Hash }, empty_bytes
+        } else {
+            self.blobhash[obj.Hash] = make([]byte, len(obj.Buf))
+            copy(self.blobhash[obj.Hash], obj.Buf)
         }
     } else {
         for _, child := range obj.Children {
@@ -593,6 +890,7 @@ func (self *Encoder) encode_int(number *big.Int, size uint) []byte {
         if number.Sign() < 0 {
             panic("jksn: number < 0")
         }
+        number = new(big.Int).Set(number)
         result := []byte{ uint8(new(big.Int).And(number, big.NewInt(0x7f)).Uint64()) }
         number.Rsh(number, 7)
         for number.Sign() != 0 {
@@ -622,6 +920,131 @@ type Decoder struct {
     lastint     *big.Int
     texthash    [256]*string
     blobhash    [256][]byte
+    timeformat  TimeFormat
+    usenumber   bool
+    // Offset and control byte of the value being read, for errors
+    valueoffset int64
+    valuecontrol uint8
+    path        []string
+    // Where the items of the last top-level value were found, and the
+    // length of path at that value
+    marks       []value_mark
+    markpath    int
+    lenient     bool
+    errs        []error
+    fatalerr    error
+    disallowunknown bool
+    exactcase   bool
+    slicemode   SliceMode
+    typetagstyle    TypeTagStyle
+    typetagkey  string
+    capture     *bytes.Buffer
+    trace       tracer
+    traceoffset int64
+    tracedepth  int
+}
+
+// SliceMode selects what happens to the existing content of a slice being
+// decoded into.
+type SliceMode int
+
+const (
+    // The slice is replaced by a new one holding only the decoded elements
+    SliceReplace SliceMode = iota
+    // Elements are decoded on top of the existing elements at the same
+    // index, so nested structs keep fields absent from the input; the
+    // length still follows the input
+    SliceMerge
+)
+
+// value_mark records where an item of a container was found, so that a type
+// error can give the offset and JKSN kind of the value at self.path without
+// a tree being kept for every value. Marks follow the order in which values
+// end, so the marks of a container's items come right before its own.
+type value_mark struct {
+    offset  int64
+    control uint8
+    // Number of marks of the value, its own included
+    size    int
+    // The key of an object item or the name of a swapped array column
+    key     interface{}
+}
+
+// mark records the value load_value just read as an item, whose own items
+// were marked from start on.
+func (self *Decoder) mark(start int, key interface{}) {
+    self.marks = append(self.marks, value_mark{ self.valueoffset, self.valuecontrol, len(self.marks) - start + 1, key })
+}
+
+// find_mark returns the mark of the value at self.path. If that value was
+// not marked, as with a row of a swapped array, exact is false and the mark
+// is that of the closest value around it.
+func (self *Decoder) find_mark() (mark value_mark, exact bool) {
+    if len(self.marks) == 0 || self.markpath > len(self.path) {
+        return value_mark{}, false
+    }
+    at, row := len(self.marks)-1, -1
+    for _, step := range self.path[self.markpath:] {
+        index, is_index := -1, false
+        if strings.HasPrefix(step, "[") && strings.HasSuffix(step, "]") {
+            var err error
+            index, err = strconv.Atoi(step[1:len(step)-1])
+            is_index = err == nil
+        }
+        control := self.marks[at].control
+        if control & 0xf0 == 0xa0 && row < 0 {
+            // Rows are found through the column named by the next step
+            if !is_index {
+                return self.marks[at], false
+            }
+            row = index
+            continue
+        }
+        items := self.mark_items(at)
+        next := -1
+        switch {
+        case control & 0xf0 == 0x90 || row >= 0:
+            for _, item := range items {
+                if self.marks[item].key != nil && path_key(self.marks[item].key) == step {
+                    next = item
+                }
+            }
+            if next >= 0 && row >= 0 {
+                if column := self.mark_items(next); row < len(column) {
+                    next, row = column[row], -1
+                } else {
+                    next = -1
+                }
+            }
+        case is_index && index >= 0 && index < len(items):
+            next = items[index]
+        }
+        if next < 0 {
+            return self.marks[at], false
+        }
+        at = next
+    }
+    if row >= 0 {
+        return value_mark{ offset: self.marks[at].offset, control: 0x90 }, true
+    }
+    return self.marks[at], true
+}
+
+// mark_items returns the marks of the items of the value marked at, in order.
+func (self *Decoder) mark_items(at int) []int {
+    var result []int
+    for item := at-1; item > at - self.marks[at].size && item >= 0; item -= self.marks[item].size {
+        result = append(result, item)
+    }
+    slices.Reverse(result)
+    return result
+}
+
+// mark_offset returns the offset of the value at self.path, or of the
+// closest value around it.
+func (self *Decoder) mark_offset() int64 {
+    mark, _ := self.find_mark()
+    return mark.offset
 }
 
 func NewDecoder(reader io.Reader) (res *Decoder) {
@@ -634,61 +1057,199 @@ func NewDecoder(reader io.Reader) (res *Decoder) {
     return
 }
 
+// derive returns a new Decoder reading from reader with the same options.
+func (self *Decoder) derive(reader io.Reader) *Decoder {
+    result := NewDecoder(reader)
+    result.timeformat, result.usenumber, result.lenient = self.timeformat, self.usenumber, self.lenient
+    result.disallowunknown, result.exactcase, result.slicemode = self.disallowunknown, self.exactcase, self.slicemode
+    result.typetagstyle, result.typetagkey = self.typetagstyle, self.typetagkey
+    return result
+}
+
 func (self *Decoder) Buffered() io.Reader {
     return self.reader
 }
 
+// InputOffset returns the number of bytes consumed from the input stream.
+func (self *Decoder) InputOffset() int64 {
+    return self.readcount
+}
+
+// SetLenient makes the Decoder continue past recoverable errors, such as
+// type mismatches or references to missing hash entries, and report all of
+// them as a MultiError. Errors in the stream itself still stop decoding,
+// and come last in the MultiError.
+func (self *Decoder) SetLenient(on bool) {
+    self.lenient = on
+}
+
+// DisallowUnknownFields causes the Decoder to return an error when an object
+// has a key which does not match any exported field of the destination struct.
+func (self *Decoder) DisallowUnknownFields() {
+    self.disallowunknown = true
+}
+
+func (self *Decoder) SetSliceMode(mode SliceMode) {
+    self.slicemode = mode
+}
+
+// RequireExactCase disables the case-insensitive fallback when matching
+// object keys to struct fields.
+func (self *Decoder) RequireExactCase() {
+    self.exactcase = true
+}
+
 func (self *Decoder) Decode(obj interface{}) (err error) {
-    self.readcount = 0
-    header, header_err := self.reader.Peek(3)
-    if header_err == nil && bytes.Equal(header, []byte("jk!")) {
-        discarded, _ := self.reader.Discard(len(header))
-        if discarded != len(header) {
-            panic("jksn: discarded != len(header)")
-        }
-        self.readcount += int64(discarded)
+    if err = self.begin_document(); err != nil {
+        return
     }
-    generic_value := self.load_value()
+    return self.decode_document(obj)
+}
+
+func (self *Decoder) decode_document(obj interface{}) error {
+    generic_value := self.load_top_value()
     if obj == nil {
         self.store_err(&InvalidUnmarshalError{
             reflect.TypeOf(obj),
         })
-        return
+    } else if !self.stopped() {
+        self.fit_type(reflect.ValueOf(obj), generic_value)
+    }
+    return self.result_err()
+}
+
+// load_top_value loads a whole top-level value. Without lenient mode, an
+// error while loading leaves the stream in the middle of the value, so it
+// becomes sticky like an I/O error.
+func (self *Decoder) load_top_value() interface{} {
+    self.marks, self.markpath = self.marks[:0], len(self.path)
+    result := self.load_value()
+    self.mark(0, nil)
+    if self.stopped() && self.fatalerr == nil {
+        self.fatalerr = self.firsterr
+    }
+    return result
+}
+
+// begin_document resets the per-document state and skips the optional
+// "jk!" header. It returns io.EOF if the stream has no more documents.
+func (self *Decoder) begin_document() error {
+    if self.fatalerr != nil {
+        return self.fatalerr
+    }
+    self.firsterr, self.errs = nil, nil
+    self.path = self.path[:0]
+    if _, peek_err := self.reader.Peek(1); peek_err == io.EOF {
+        return io.EOF
+    }
+    header, header_err := self.reader.Peek(3)
+    if header_err == nil && bytes.Equal(header, []byte("jk!")) {
+        self.discard(len(header))
+    }
+    return nil
+}
+
+// peek_control skips padding bytes and hash table refreshers and returns the
+// next control byte without consuming it. ok is false at the end of the
+// stream or after an error.
+func (self *Decoder) peek_control() (control uint8, ok bool) {
+    for !self.stopped() {
+        peek, err := self.reader.Peek(1)
+        if err != nil {
+            return 0, false
+        }
+        switch {
+        case peek[0] == 0xca:
+            self.discard(1)
+        case peek[0] & 0xf0 == 0x70: {
+            self.valueoffset = self.readcount
+            control, _ := self.read_byte()
+            self.skip_refresher(control)
+        }
+        default:
+            return peek[0], true
+        }
+    }
+    return 0, false
+}
+
+// is_container reports whether control starts a straight array, an object or
+// a lengthless array, whose items follow the header one after another.
+func is_container(control uint8) bool {
+    return control & 0xf0 == 0x80 || control & 0xf0 == 0x90 || control == 0xc8
+}
+
+// open_container consumes the header of a value for which is_container is
+// true and returns its length, which is 0 for lengthless arrays.
+func (self *Decoder) open_container(control uint8) (length uint64) {
+    self.valueoffset, self.valuecontrol = self.readcount, control
+    self.read_byte()
+    switch control {
+    case 0x8d, 0x9d:
+        length = self.decode_length(2)
+    case 0x8e, 0x9e:
+        length = self.decode_length(1)
+    case 0x8f, 0x9f:
+        length = self.decode_length(0)
+    case 0xc8:
+    default:
+        length = uint64(control & 0xf)
+    }
+    return
+}
+
+// result_err returns the error of the current document. In lenient mode it
+// holds every error recorded, the last of which may be the fatal one that
+// stopped decoding.
+func (self *Decoder) result_err() error {
+    switch {
+    case !self.lenient || len(self.errs) == 0:
+        return self.firsterr
+    case self.fatalerr != nil && len(self.errs) == 1:
+        return self.fatalerr
+    default:
+        return MultiError(self.errs)
     }
-    self.fit_type(reflect.ValueOf(obj), generic_value)
-    return self.firsterr
 }
 
 func (self *Decoder) load_value() interface{} {
     for {
-        control, err := self.reader.ReadByte()
-        self.store_err(err)
+        if self.stopped() {
+            self.valueoffset = self.readcount
+            return nil
+        }
+        control, err := self.read_byte()
         if err != nil {
+            self.valueoffset = self.readcount
             return nil
         }
-        self.readcount++
+        self.valueoffset, self.valuecontrol = self.readcount-1, control
         ctrlhi := control & 0xf0
         switch ctrlhi {
         // Special values
         case 0x00:
             switch control {
-            case 0x00, 0x01:
+            case 0x00:
+                return undefined_value
+            case 0x01:
                 return nil
             case 0x02:
                 return false
             case 0x03:
                 return true
             case 0x0f: {
+                offset, start := self.valueoffset, len(self.marks)
                 json_literal := self.load_value()
+                self.valueoffset, self.valuecontrol, self.marks = offset, control, self.marks[:start]
                 if s, ok := json_literal.(string); ok {
-                    var result interface{}
-                    self.store_err(json.Unmarshal([]byte(s), &result))
-                    return result
+                    return self.load_json_literal(s)
                 } else {
                     self.store_err(&SyntaxError{
-                        "jksn: JKSN value 0x0f requires a string but found: " + reflect.TypeOf(json_literal).String(),
-                        self.readcount,
+                        "jksn: JKSN value 0x0f requires a string but found: " + generic_kind(json_literal),
+                        offset,
+                        nil,
                     })
+                    return nil
                 }
             }
             }
@@ -715,24 +1276,20 @@ func (self *Decoder) load_value() interface{} {
             switch control {
             case 0x20:
                 return math.NaN()
-            case 0x2b:
-                self.store_err(&UnmarshalTypeError{
-                    "float80",
-                    reflect.TypeOf(0),
-                    self.readcount,
-                })
-                return math.NaN()
+            case 0x2b: {
+                var buf [10]byte
+                self.read_full(buf[:])
+                return float80_to_generic(buf)
+            }
             case 0x2c: {
-                var result float64
-                self.store_err(binary.Read(self.reader, binary.BigEndian, &result))
-                self.readcount += 8
-                return result
+                var buf [8]byte
+                self.read_full(buf[:])
+                return math.Float64frombits(binary.BigEndian.Uint64(buf[:]))
             }
             case 0x2d: {
-                var result float32
-                self.store_err(binary.Read(self.reader, binary.BigEndian, &result))
-                self.readcount += 4
-                return result
+                var buf [4]byte
+                self.read_full(buf[:])
+                return math.Float32frombits(binary.BigEndian.Uint32(buf[:]))
             }
             case 0x2e:
                 return math.Inf(-1)
@@ -743,76 +1300,75 @@ func (self *Decoder) load_value() interface{} {
         case 0x30:
             switch control {
             default:
-                return self.load_string_utf16le(uint(control & 0xf))
+                return self.load_string_utf16le(uint64(control & 0xf))
             case 0x3c: {
-                hashvalue, err := self.reader.ReadByte()
-                self.store_err(err)
+                hashvalue, err := self.read_byte()
                 if err != nil {
                     return ""
                 }
-                self.readcount++
                 if self.texthash[hashvalue] != nil {
                     return *self.texthash[hashvalue]
                 } else {
                     self.store_err(&SyntaxError{
-                        fmt.Sprintf("JKSN stream requires a non-existing hash: 0x%02x", hashvalue),
-                        self.readcount,
+                        fmt.Sprintf("jksn: JKSN stream requires a non-existing hash: 0x%02x", hashvalue),
+                        self.valueoffset,
+                        nil,
                     })
                     return ""
                 }
             }
             case 0x3d:
-                return self.load_string_utf16le(uint(self.decode_int(2).Uint64()))
+                return self.load_string_utf16le(self.decode_length(2))
             case 0x3e:
-                return self.load_string_utf16le(uint(self.decode_int(1).Uint64()))
+                return self.load_string_utf16le(self.decode_length(1))
             case 0x3f:
-                return self.load_string_utf16le(uint(self.decode_int(0).Uint64()))
+                return self.load_string_utf16le(self.decode_length(0))
             }
         // UTF-8 strings
         case 0x40:
             switch control {
             default:
-                return self.load_string_utf8(uint(control & 0xf))
+                return self.load_string_utf8(uint64(control & 0xf))
             case 0x4d:
-                return self.load_string_utf8(uint(self.decode_int(2).Uint64()))
+                return self.load_string_utf8(self.decode_length(2))
             case 0x4e:
-                return self.load_string_utf8(uint(self.decode_int(1).Uint64()))
+                return self.load_string_utf8(self.decode_length(1))
             case 0x4f:
-                return self.load_string_utf8(uint(self.decode_int(0).Uint64()))
+                return self.load_string_utf8(self.decode_length(0))
             }
         // Blob strings
         case 0x50:
             switch control {
             default:
-                return self.load_bytes(uint(control & 0xf))
+                return self.load_bytes(uint64(control & 0xf))
             case 0x5c: {
-                hashvalue, err := self.reader.ReadByte()
-                self.store_err(err)
+                hashvalue, err := self.read_byte()
                 if err != nil {
-                    return ""
+                    return []byte("")
                 }
-                self.readcount++
                 if self.blobhash[hashvalue] != nil {
                     result := make([]byte, len(self.blobhash[hashvalue]))
                     copy(result, self.blobhash[hashvalue])
                     return result
                 } else {
                     self.store_err(&SyntaxError{
-                        fmt.Sprintf("JKSN stream requires a non-existing hash: 0x%02x", hashvalue),
-                        self.readcount,
+                        fmt.Sprintf("jksn: JKSN stream requires a non-existing hash: 0x%02x", hashvalue),
+                        self.valueoffset,
+                        nil,
                     })
                     return []byte("")
                 }
             }
             case 0x5d:
-                return self.load_bytes(uint(self.decode_int(2).Uint64()))
+                return self.load_bytes(self.decode_length(2))
             case 0x5e:
-                return self.load_bytes(uint(self.decode_int(1).Uint64()))
+                return self.load_bytes(self.decode_length(1))
             case 0x5f:
-                return self.load_bytes(uint(self.decode_int(0).Uint64()))
+                return self.load_bytes(self.decode_length(0))
             }
         // Hashtable refreshers
-        case 0x70:
+        case 0x70: {
+            start := len(self.marks)
             switch control {
             case 0x70:
                 for i := range self.texthash {
@@ -823,21 +1379,21 @@ func (self *Decoder) load_value() interface{} {
                 }
             default: {
                 count := control & 0xf
-                for count != 0 {
+                for count != 0 && !self.stopped() {
                     self.load_value()
                     count--
                 }
             }
             case 0x7d: {
                 count := self.decode_int(2).Uint64()
-                for count != 0 {
+                for count != 0 && !self.stopped() {
                     self.load_value()
                     count--
                 }
             }
             case 0x7e: {
                 count := self.decode_int(1).Uint64()
-                for count != 0 {
+                for count != 0 && !self.stopped() {
                     self.load_value()
                     count--
                 }
@@ -845,13 +1401,16 @@ func (self *Decoder) load_value() interface{} {
             case 0x7f: {
                 count := self.decode_int(0)
                 one := big.NewInt(1)
-                for count.Sign() > 0 {
+                for count.Sign() > 0 && !self.stopped() {
                     self.load_value()
                     count.Sub(count, one)
                 }
             }
             }
+            // Values refreshed into the hash tables are not items
+            self.marks = self.marks[:start]
             continue
+        }
         // Arrays
         case 0x80: {
             var length uint64
@@ -859,16 +1418,20 @@ func (self *Decoder) load_value() interface{} {
             default:
                 length = uint64(control & 0xf)
             case 0x8d:
-                length = self.decode_int(2).Uint64()
+                length = self.decode_length(2)
             case 0x8e:
-                length = self.decode_int(1).Uint64()
+                length = self.decode_length(1)
             case 0x8f:
-                length = self.decode_int(0).Uint64()
+                length = self.decode_length(0)
             }
-            result := make([]interface{}, length)
-            for i := range result {
-                result[i] = self.load_value()
+            offset := self.valueoffset
+            result := make([]interface{}, 0, prealloc_length(length))
+            for i := uint64(0); i < length && !self.stopped(); i++ {
+                start := len(self.marks)
+                result = append(result, self.load_value())
+                self.mark(start, nil)
             }
+            self.valueoffset, self.valuecontrol = offset, control
             return result
         }
         // Objects
@@ -878,33 +1441,43 @@ func (self *Decoder) load_value() interface{} {
             default:
                 length = uint64(control & 0xf)
             case 0x9d:
-                length = self.decode_int(2).Uint64()
+                length = self.decode_length(2)
             case 0x9e:
-                length = self.decode_int(1).Uint64()
+                length = self.decode_length(1)
             case 0x9f:
-                length = self.decode_int(0).Uint64()
+                length = self.decode_length(0)
             }
-            result := make(map[interface{}]interface{}, length)
-            for i := uint64(0); i < length; i++ {
-                key := self.load_value()
-                result[key] = self.load_value()
+            offset := self.valueoffset
+            result := make(map[interface{}]interface{}, prealloc_length(length))
+            for i := uint64(0); i < length && !self.stopped(); i++ {
+                start := len(self.marks)
+                key, key_ok := self.hashable_key(self.load_value())
+                self.marks = self.marks[:start]
+                item := self.load_value()
+                if key_ok {
+                    result[key] = item
+                    self.mark(start, key)
+                } else {
+                    self.marks = self.marks[:start]
+                }
             }
+            self.valueoffset, self.valuecontrol = offset, control
             return result
         }
         // Row-col swapped arrays
         case 0xa0: {
-            var length uint
+            var length uint64
             switch control {
             case 0xa0:
                 return unspecified_value
             default:
-                length = uint(control & 0xf)
+                length = uint64(control & 0xf)
             case 0xad:
-                length = uint(self.decode_int(2).Uint64())
+                length = self.decode_length(2)
             case 0xae:
-                length = uint(self.decode_int(1).Uint64())
+                length = self.decode_length(1)
             case 0xaf:
-                length = uint(self.decode_int(0).Uint64())
+                length = self.decode_length(0)
             }
             return self.load_swapped_array(length)
         }
@@ -912,13 +1485,21 @@ func (self *Decoder) load_value() interface{} {
             switch control {
             // Lengthless arrays
             case 0xc8: {
+                offset := self.valueoffset
                 result := make([]interface{}, 0)
                 for {
+                    start := len(self.marks)
                     item := self.load_value()
                     switch item.(type) {
                     default:
                         result = append(result, item)
+                        self.mark(start, nil)
                     case unspecified:
+                        self.valueoffset, self.valuecontrol = offset, control
+                        return result
+                    }
+                    if self.stopped() {
+                        self.valueoffset, self.valuecontrol = offset, control
                         return result
                     }
                 }
@@ -936,11 +1517,11 @@ func (self *Decoder) load_value() interface{} {
             case 0xd6, 0xd7, 0xd8, 0xd9, 0xda:
                 delta = big.NewInt(int64(control & 0xf) - 11)
             case 0xdb:
-                delta = self.decode_int(4)
+                delta = self.unsigned_to_signed(self.decode_int(4), 32)
             case 0xdc:
-                delta = self.decode_int(2)
+                delta = self.unsigned_to_signed(self.decode_int(2), 16)
             case 0xdd:
-                delta = self.decode_int(1)
+                delta = self.unsigned_to_signed(self.decode_int(1), 8)
             case 0xde:
                 delta = self.decode_int(0)
                 delta.Neg(delta)
@@ -952,123 +1533,355 @@ func (self *Decoder) load_value() interface{} {
                 return new(big.Int).Set(self.lastint)
             } else {
                 self.store_err(&SyntaxError{
-                    "JKSN stream contains an invalid delta encoded integer",
-                    self.readcount,
+                    "jksn: JKSN stream contains an invalid delta encoded integer",
+                    self.valueoffset,
+                    nil,
                 })
                 return new(big.Int)
             }
         }
         case 0xf0:
             if control <= 0xf5 {
-                switch control {
-                case 0xf0:
-                    self.reader.Discard(1)
-                    self.readcount++
-                case 0xf1:
-                    self.reader.Discard(4)
-                    self.readcount += 4
-                case 0xf2:
-                    self.reader.Discard(16)
-                    self.readcount += 16
-                case 0xf3:
-                    self.reader.Discard(20)
-                    self.readcount += 20
-                case 0xf4:
-                    self.reader.Discard(32)
-                    self.readcount += 32
-                case 0xf5:
-                    self.reader.Discard(64)
-                    self.readcount += 64
-                }
+                self.discard(checksum_length(control))
                 continue
             } else if control >= 0xf8 && control <= 0xfd {
                 result := self.load_value()
-                switch control {
-                case 0xf8:
-                    self.reader.Discard(1)
-                    self.readcount++
-                case 0xf9:
-                    self.reader.Discard(4)
-                    self.readcount += 4
-                case 0xfa:
-                    self.reader.Discard(16)
-                    self.readcount += 16
-                case 0xfb:
-                    self.reader.Discard(20)
-                    self.readcount += 20
-                case 0xfc:
-                    self.reader.Discard(32)
-                    self.readcount += 32
-                case 0xfd:
-                    self.reader.Discard(64)
-                    self.readcount += 64
-                }
+                self.discard(checksum_length(control))
                 return result
             } else if control == 0xff {
+                start := len(self.marks)
                 self.load_value()
+                self.marks = self.marks[:start]
                 continue
             }
         }
-        self.store_err(&SyntaxError{
+        self.store_fatal(&SyntaxError{
             fmt.Sprintf("jksn: cannot decode JKSN from byte 0x%02x", control),
             self.readcount-1,
+            nil,
         })
         return nil
     }
 }
 
-func (self *Decoder) load_string_utf8(length uint) string {
-    buf := make([]byte, length)
+func checksum_length(control uint8) int {
+    switch control & 0xf7 {
+    case 0xf0:
+        return 1
+    case 0xf1:
+        return 4
+    case 0xf2:
+        return 16
+    case 0xf3:
+        return 20
+    case 0xf4:
+        return 32
+    case 0xf5:
+        return 64
+    default:
+        return 0
+    }
+}
+
+func control_kind(control uint8) string {
+    switch control & 0xf0 {
+    case 0x00:
+        switch control {
+        case 0x00:
+            return "undefined"
+        case 0x01:
+            return "null"
+        case 0x02, 0x03:
+            return "boolean"
+        case 0x0f:
+            return "json literal"
+        }
+    case 0x10:
+        return "integer"
+    case 0x20:
+        switch control {
+        case 0x20:
+            return "NaN"
+        case 0x2b:
+            return "float80"
+        case 0x2c:
+            return "float64"
+        case 0x2d:
+            return "float32"
+        case 0x2e, 0x2f:
+            return "infinity"
+        }
+    case 0x30:
+        if control == 0x3c {
+            return "string reference"
+        }
+        return "utf16 string"
+    case 0x40:
+        return "utf8 string"
+    case 0x50:
+        if control == 0x5c {
+            return "blob reference"
+        }
+        return "blob"
+    case 0x70:
+        return "hashtable refresher"
+    case 0x80:
+        return "array"
+    case 0x90:
+        return "object"
+    case 0xa0:
+        if control == 0xa0 {
+            return "unspecified"
+        }
+        return "swapped array"
+    case 0xc0:
+        switch control {
+        case 0xc8:
+            return "lengthless array"
+        case 0xca:
+            return "padding"
+        }
+    case 0xd0:
+        return "delta integer"
+    case 0xf0:
+        switch {
+        case control <= 0xf5:
+            return "checksum"
+        case control >= 0xf8 && control <= 0xfd:
+            return "checksummed value"
+        case control == 0xff:
+            return "pragma"
+        }
+    }
+    return fmt.Sprintf("unknown control 0x%02x", control)
+}
+
+func generic_kind(generic_value interface{}) string {
+    switch generic_value.(type) {
+    case nil:
+        return "null"
+    case undefined:
+        return "undefined"
+    case bool:
+        return "boolean"
+    case *big.Int:
+        return "integer"
+    case float32, float64, *big.Float:
+        return "float"
+    case json.Number:
+        return "number"
+    case string:
+        return "string"
+    case []byte:
+        return "blob"
+    case []interface{}, []map[interface{}]interface{}:
+        return "array"
+    case map[interface{}]interface{}:
+        return "object"
+    case unspecified:
+        return "unspecified"
+    default:
+        return reflect.TypeOf(generic_value).String()
+    }
+}
+
+func (self *Decoder) read_byte() (byte, error) {
+    if self.stopped() {
+        return 0, self.firsterr
+    }
+    result, err := self.reader.ReadByte()
+    if err != nil {
+        err = self.read_error(err)
+        self.store_fatal(err)
+        return 0, err
+    }
+    self.readcount++
+    if self.capture != nil {
+        self.capture.WriteByte(result)
+    }
+    return result, nil
+}
+
+func (self *Decoder) read_full(buf []byte) error {
+    if self.stopped() {
+        return self.firsterr
+    }
     n, err := io.ReadFull(self.reader, buf)
-    self.store_err(err)
     self.readcount += int64(n)
+    if self.capture != nil {
+        self.capture.Write(buf[:n])
+    }
+    if err != nil {
+        err = self.read_error(err)
+        self.store_fatal(err)
+    }
+    return err
+}
+
+// read_bytes grows its buffer as data arrives, so that a corrupted length
+// prefix fails with an error at the end of the stream instead of allocating
+// the whole claimed length up front.
+func (self *Decoder) read_bytes(length uint64) ([]byte, error) {
+    if length <= 0x10000 {
+        buf := make([]byte, length)
+        return buf, self.read_full(buf)
+    }
+    if self.stopped() {
+        return nil, self.firsterr
+    }
+    var buf bytes.Buffer
+    n, err := io.CopyN(&buf, self.reader, int64(length))
+    self.readcount += n
+    if self.capture != nil {
+        self.capture.Write(buf.Bytes())
+    }
+    if err != nil {
+        err = self.read_error(err)
+        self.store_fatal(err)
+    }
+    return buf.Bytes(), err
+}
+
+func (self *Decoder) discard(length int) error {
+    if self.stopped() {
+        return self.firsterr
+    }
+    if self.capture != nil {
+        return self.read_full(make([]byte, length))
+    }
+    n, err := self.reader.Discard(length)
+    self.readcount += int64(n)
+    if err != nil {
+        err = self.read_error(err)
+        self.store_fatal(err)
+    }
+    return err
+}
+
+func (self *Decoder) decode_length(size uint) uint64 {
+    length := self.decode_int(size)
+    if !length.IsInt64() {
+        self.store_fatal(&SyntaxError{ "jksn: length prefix out of range: " + length.String(), self.valueoffset, nil })
+        return 0
+    }
+    return length.Uint64()
+}
+
+func prealloc_length(length uint64) int {
+    if length > 0x1000 {
+        return 0x1000
+    }
+    return int(length)
+}
+
+func (self *Decoder) hashable_key(key interface{}) (interface{}, bool) {
+    switch key.(type) {
+    case undefined:
+        return nil, true
+    case []byte:
+        // Blob keys cannot be Go map keys; use their content as a string
+        return string(key.([]byte)), true
+    case []interface{}, []map[interface{}]interface{}, map[interface{}]interface{}:
+        self.store_err(&SyntaxError{ "jksn: object key of type " + generic_kind(key) + " is not supported", self.valueoffset, nil })
+        return nil, false
+    default:
+        return key, true
+    }
+}
+
+func (self *Decoder) read_error(err error) error {
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        return &SyntaxError{ "jksn: unexpected end of JKSN stream", self.readcount, io.ErrUnexpectedEOF }
+    }
+    return &ReadError{ self.readcount, err }
+}
+
+func (self *Decoder) type_error(generic_value interface{}, target reflect.Type) *UnmarshalTypeError {
+    // fit_type always works on a pointer to the destination
+    result := &UnmarshalTypeError{ generic_kind(generic_value), target.Elem(), 0, path_string(self.path), nil }
+    mark, exact := self.find_mark()
+    result.Offset = mark.offset
+    if exact {
+        result.Value = control_kind(mark.control)
+    }
+    return result
+}
+
+func (self *Decoder) type_error_cause(generic_value interface{}, target reflect.Type, cause error) *UnmarshalTypeError {
+    result := self.type_error(generic_value, target)
+    result.Err = cause
+    return result
+}
+
+func (self *Decoder) load_string_utf8(length uint64) string {
+    buf, err := self.read_bytes(length)
+    if err != nil {
+        return ""
+    }
     res := string(buf)
     self.texthash[djb_hash(buf)] = &res
     return res
 }
 
-func (self *Decoder) load_string_utf16le(length uint) string {
-    buf := make([]byte, length*2)
-    n, err := io.ReadFull(self.reader, buf)
-    self.store_err(err)
-    self.readcount += int64(n)
+func (self *Decoder) load_string_utf16le(length uint64) string {
+    if length > math.MaxInt64/2 {
+        self.store_fatal(&SyntaxError{ "jksn: string length out of range", self.valueoffset, nil })
+        return ""
+    }
+    buf, err := self.read_bytes(length*2)
+    if err != nil {
+        return ""
+    }
     res := utf16le_to_utf8(buf)
     self.texthash[djb_hash(buf)] = &res
     return res
 }
 
-func (self *Decoder) load_bytes(length uint) []byte {
-    buf := make([]byte, length)
-    n, err := io.ReadFull(self.reader, buf)
-    self.store_err(err)
-    self.readcount += int64(n)
+func (self *Decoder) load_bytes(length uint64) []byte {
+    buf, err := self.read_bytes(length)
+    if err != nil {
+        return []byte("")
+    }
     self.blobhash[djb_hash(buf)] = buf
     res := make([]byte, length)
     copy(res, buf)
     return res
 }
 
-func (self *Decoder) load_swapped_array(column_length uint) (result []map[interface{}]interface{}) {
-    for i := uint(0); i < column_length; i++ {
-        column_name := self.load_value()
+// load_swapped_array reads the columns of a row-col swapped array. Each
+// column is marked with its name, and holds the marks of its cells.
+func (self *Decoder) load_swapped_array(column_length uint64) (result []map[interface{}]interface{}) {
+    offset, control := self.valueoffset, self.valuecontrol
+    for i := uint64(0); i < column_length && !self.stopped(); i++ {
+        start := len(self.marks)
+        column_name, column_ok := self.hashable_key(self.load_value())
+        self.marks = self.marks[:start]
         column_values_general := self.load_value()
-        if column_values, ok := column_values_general.([]interface{}); ok {
-            for idx, value := range column_values {
-                if idx == len(result) {
-                    result = append(result, make(map[interface{}]interface{}))
-                }
-                switch value.(type) {
-                case unspecified:
-                default:
-                    result[idx][column_name] = value
-                }
+        column_values, ok := column_values_general.([]interface{})
+        if !ok || !column_ok {
+            self.marks = self.marks[:start]
+            continue
+        }
+        self.mark(start, column_name)
+        for idx, value := range column_values {
+            if idx == len(result) {
+                result = append(result, make(map[interface{}]interface{}))
+            }
+            switch value.(type) {
+            case unspecified:
+            default:
+                result[idx][column_name] = value
             }
         }
     }
+    self.valueoffset, self.valuecontrol = offset, control
     return
 }
 
 func (self *Decoder) fit_type(value reflect.Value, generic_value interface{}) {
+    if self.stopped() {
+        return
+    }
     if value.Kind() != reflect.Ptr {
         if value.CanAddr() {
             value = value.Addr()
@@ -1079,40 +1892,71 @@ func (self *Decoder) fit_type(value reflect.Value, generic_value interface{}) {
             return
         }
     }
-    if value.IsNil() || generic_value == nil {
+    if value.Type().Elem() == value_type && (!value.IsNil() || value.CanSet()) {
+        if value.IsNil() {
+            value.Set(reflect.New(value_type))
+        }
+        value.Elem().Set(reflect.ValueOf(value_from_generic(generic_value)).Elem())
+        return
+    }
+    if generic_value == nil || generic_value == undefined_value {
+        if !value.IsNil() {
+            switch value.Type().Elem().Kind() {
+            case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+                value.Elem().Set(reflect.Zero(value.Type().Elem()))
+            }
+        }
+        return
+    }
+    if value.IsNil() {
         value.Set(reflect.New(value.Type().Elem()))
     }
-    if generic_value == nil {
+    if self.fit_std(value, generic_value) {
         return
     }
+    if generic_number, ok := generic_value.(json.Number); ok {
+        switch value.Type().Elem().Kind() {
+        case reflect.Interface, reflect.Ptr, reflect.String:
+        default:
+            generic_value = json_number_to_generic(generic_number)
+        }
+    }
     generic_reflect_value := reflect.ValueOf(generic_value)
     obj := value.Interface()
     switch value.Type().Elem().Kind() {
     case reflect.Interface:
-        *obj.(*interface{}) = generic_value
+        if value.Type().Elem().NumMethod() == 0 {
+            value.Elem().Set(reflect.ValueOf(self.export_value(generic_value)))
+        } else {
+            self.fit_registered(value, generic_value)
+        }
     case reflect.Ptr:
         switch obj.(type) {
-        case *big.Int:
+        case **big.Int:
             switch generic_reflect_value.Kind() {
             case reflect.Ptr:
                 switch generic_value.(type) {
                 case *big.Int:
-                    value.Set(generic_reflect_value)
+                    value.Elem().Set(generic_reflect_value)
+                case *big.Float: {
+                    generic_int, _ := generic_value.(*big.Float).Int(nil)
+                    value.Elem().Set(reflect.ValueOf(generic_int))
+                }
                 default:
-                    self.fit_type(value.Elem(), generic_value)
+                    self.store_err(self.type_error(generic_value, value.Type()))
                 }
             case reflect.Bool:
                 if generic_value.(bool) {
-                    value.Set(reflect.ValueOf(big.NewInt(1)))
+                    value.Elem().Set(reflect.ValueOf(big.NewInt(1)))
                 } else {
-                    value.Set(reflect.ValueOf(big.NewInt(0)))
+                    value.Elem().Set(reflect.ValueOf(big.NewInt(0)))
                 }
             case reflect.Float32:
-                value.Set(reflect.ValueOf(big.NewInt(int64(generic_value.(float32)))))
+                value.Elem().Set(reflect.ValueOf(big.NewInt(int64(generic_value.(float32)))))
             case reflect.Float64:
-                value.Set(reflect.ValueOf(big.NewInt(int64(generic_value.(float64)))))
+                value.Elem().Set(reflect.ValueOf(big.NewInt(int64(generic_value.(float64)))))
             default:
-                self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+                self.store_err(self.type_error(generic_value, value.Type()))
             }
         default:
             self.fit_type(value.Elem(), generic_value)
@@ -1123,8 +1967,10 @@ func (self *Decoder) fit_type(value reflect.Value, generic_value interface{}) {
             switch generic_value.(type) {
             case *big.Int:
                 *obj.(*bool) = generic_value.(*big.Int).Sign() != 0
+            case *big.Float:
+                *obj.(*bool) = generic_value.(*big.Float).Sign() != 0
             default:
-                self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+                self.store_err(self.type_error(generic_value, value.Type()))
             }
         case reflect.Bool:
             *obj.(*bool) = generic_value.(bool)
@@ -1134,19 +1980,18 @@ func (self *Decoder) fit_type(value reflect.Value, generic_value interface{}) {
             *obj.(*bool) = generic_value.(float64) != 0
         case reflect.String:
             *obj.(*bool) = len(generic_value.(string)) != 0
-        case reflect.Slice:
-            *obj.(*bool) = len(generic_value.([]interface{})) != 0
-        case reflect.Map:
-            *obj.(*bool) = len(generic_value.(map[interface{}]interface{})) != 0
+        case reflect.Slice, reflect.Map:
+            // Blobs and swapped arrays are slices of other types
+            *obj.(*bool) = generic_reflect_value.Len() != 0
         case reflect.Struct:
             switch generic_value.(type) {
             case unspecified:
                 *obj.(*bool) = false
             default:
-                self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+                self.store_err(self.type_error(generic_value, value.Type()))
             }
         default:
-            self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+            self.store_err(self.type_error(generic_value, value.Type()))
         }
     case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
         switch generic_reflect_value.Kind() {
@@ -1154,8 +1999,12 @@ func (self *Decoder) fit_type(value reflect.Value, generic_value interface{}) {
             switch generic_value.(type) {
             case *big.Int:
                 value.Elem().SetInt(generic_value.(*big.Int).Int64())
+            case *big.Float: {
+                generic_int, _ := generic_value.(*big.Float).Int64()
+                value.Elem().SetInt(generic_int)
+            }
             default:
-                self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+                self.store_err(self.type_error(generic_value, value.Type()))
             }
         case reflect.Bool:
             if generic_value.(bool) {
@@ -1170,7 +2019,7 @@ func (self *Decoder) fit_type(value reflect.Value, generic_value interface{}) {
         case reflect.Float64:
             value.Elem().SetInt(int64(generic_value.(float64)))
         default:
-            self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+            self.store_err(self.type_error(generic_value, value.Type()))
         }
     case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
         switch generic_reflect_value.Kind() {
@@ -1178,8 +2027,12 @@ func (self *Decoder) fit_type(value reflect.Value, generic_value interface{}) {
             switch generic_value.(type) {
             case *big.Int:
                 value.Elem().SetUint(generic_value.(*big.Int).Uint64())
+            case *big.Float: {
+                generic_uint, _ := generic_value.(*big.Float).Uint64()
+                value.Elem().SetUint(generic_uint)
+            }
             default:
-                self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+                self.store_err(self.type_error(generic_value, value.Type()))
             }
         case reflect.Bool:
             if generic_value.(bool) {
@@ -1194,7 +2047,61 @@ func (self *Decoder) fit_type(value reflect.Value, generic_value interface{}) {
         case reflect.Float64:
             value.Elem().SetUint(uint64(generic_value.(float64)))
         default:
-            self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+            self.store_err(self.type_error(generic_value, value.Type()))
+        }
+    case reflect.Float32, reflect.Float64:
+        switch generic_reflect_value.Kind() {
+        case reflect.Ptr:
+            switch generic_value.(type) {
+            case *big.Int: {
+                generic_float, _ := new(big.Float).SetInt(generic_value.(*big.Int)).Float64()
+                value.Elem().SetFloat(generic_float)
+            }
+            case *big.Float:
+                if value.Type().Elem().Kind() == reflect.Float32 {
+                    generic_float, _ := generic_value.(*big.Float).Float32()
+                    value.Elem().SetFloat(float64(generic_float))
+                } else {
+                    generic_float, _ := generic_value.(*big.Float).Float64()
+                    value.Elem().SetFloat(generic_float)
+                }
+            default:
+                self.store_err(self.type_error(generic_value, value.Type()))
+            }
+        case reflect.Bool:
+            if generic_value.(bool) {
+                value.Elem().SetFloat(1)
+            } else {
+                value.Elem().SetFloat(0)
+            }
+        case reflect.Float32, reflect.Float64:
+            value.Elem().SetFloat(generic_reflect_value.Float())
+        default:
+            self.store_err(self.type_error(generic_value, value.Type()))
+        }
+    case reflect.Complex64, reflect.Complex128:
+        var re, im interface{}
+        switch generic_value.(type) {
+        case []interface{}:
+            if generic_array := generic_value.([]interface{}); len(generic_array) == 2 {
+                re, im = generic_array[0], generic_array[1]
+            }
+        case map[interface{}]interface{}:
+            _, re, _ = self.find_map_key(generic_value.(map[interface{}]interface{}), "re")
+            _, im, _ = self.find_map_key(generic_value.(map[interface{}]interface{}), "im")
+        default:
+            re, im = generic_value, 0.0
+        }
+        var re_float, im_float float64
+        if re == nil || im == nil {
+            self.store_err(self.type_error(generic_value, value.Type()))
+        } else {
+            self.path = append(self.path, ".re")
+            self.fit_type(reflect.ValueOf(&re_float), re)
+            self.path[len(self.path)-1] = ".im"
+            self.fit_type(reflect.ValueOf(&im_float), im)
+            self.path = self.path[:len(self.path)-1]
+            value.Elem().SetComplex(complex(re_float, im_float))
         }
     case reflect.String:
         switch generic_value.(type) {
@@ -1211,60 +2118,76 @@ func (self *Decoder) fit_type(value reflect.Value, generic_value interface{}) {
             left_length := value.Len()
             right_length := generic_reflect_value.Len()
             if left_length < right_length {
-                self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+                self.store_err(self.type_error(generic_value, value.Type()))
             }
             for i := 0; i < left_length; i++ {
                 if i < right_length {
+                    self.path = append(self.path, path_index(i))
                     self.fit_type(value.Elem().Index(i).Addr(), generic_reflect_value.Index(i).Interface())
+                    self.path = self.path[:len(self.path)-1]
                 } else {
                     value.Elem().Index(i).Set(reflect.New(value.Type().Elem().Elem()).Elem())
                 }
             }
         }
         default:
-            self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+            self.store_err(self.type_error(generic_value, value.Type()))
         }
     case reflect.Slice:
         switch generic_reflect_value.Kind() {
         case reflect.String, reflect.Slice: {
             length := generic_reflect_value.Len()
-            value.Elem().Set(reflect.MakeSlice(reflect.SliceOf(value.Type().Elem().Elem()), length, length))
+            result := reflect.MakeSlice(value.Type().Elem(), length, length)
+            if self.slicemode == SliceMerge {
+                reflect.Copy(result, value.Elem())
+            }
+            value.Elem().Set(result)
             for i := 0; i < length; i++ {
+                self.path = append(self.path, path_index(i))
                 self.fit_type(value.Elem().Index(i).Addr(), generic_reflect_value.Index(i).Interface())
+                self.path = self.path[:len(self.path)-1]
             }
         }
         default:
-            self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+            self.store_err(self.type_error(generic_value, value.Type()))
         }
     case reflect.Map:
         switch generic_reflect_value.Kind() {
         case reflect.Map: {
             map_key_type := value.Type().Elem().Key()
             map_value_type := value.Type().Elem().Elem()
-            value.Elem().Set(reflect.MakeMap(reflect.MapOf(map_key_type, map_value_type)))
+            if value.Elem().IsNil() {
+                value.Elem().Set(reflect.MakeMap(reflect.MapOf(map_key_type, map_value_type)))
+            }
             for map_key, map_value := range generic_value.(map[interface{}]interface{}) {
+                self.path = append(self.path, path_key(map_key))
                 map_key_fit := reflect.New(map_key_type)
                 self.fit_type(map_key_fit, map_key)
                 map_value_fit := reflect.New(map_value_type)
                 self.fit_type(map_value_fit, map_value)
+                self.path = self.path[:len(self.path)-1]
                 value.Elem().SetMapIndex(map_key_fit.Elem(), map_value_fit.Elem())
             }
         }
         case reflect.Slice, reflect.String: {
             map_key_type := value.Type().Elem().Key()
             map_value_type := value.Type().Elem().Elem()
-            value.Elem().Set(reflect.MakeMap(reflect.MapOf(map_key_type, map_value_type)))
+            if value.Elem().IsNil() {
+                value.Elem().Set(reflect.MakeMap(reflect.MapOf(map_key_type, map_value_type)))
+            }
             length := generic_reflect_value.Len()
             for i := 0; i < length; i++ {
+                self.path = append(self.path, path_index(i))
                 map_key_fit := reflect.New(map_key_type)
-                self.fit_type(map_key_fit, i)
+                self.fit_type(map_key_fit, big.NewInt(int64(i)))
                 map_value_fit := reflect.New(map_value_type)
                 self.fit_type(map_value_fit, generic_reflect_value.Index(i).Interface())
+                self.path = self.path[:len(self.path)-1]
                 value.Elem().SetMapIndex(map_key_fit.Elem(), map_value_fit.Elem())
             }
         }
         default:
-            self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+            self.store_err(self.type_error(generic_value, value.Type()))
         }
     case reflect.Struct:
         switch generic_reflect_value.Kind() {
@@ -1272,93 +2195,100 @@ func (self *Decoder) fit_type(value reflect.Value, generic_value interface{}) {
             typeof_value := value.Elem().Type()
             num_field := typeof_value.NumField()
             generic_map := generic_value.(map[interface{}]interface{})
+            matched_keys := make(map[interface{}]bool, len(generic_map))
             for i := 0; i < num_field; i++ {
-                struct_field := typeof_value.Field(i)
-                res, ok := self.find_map_key(generic_map, struct_field.Tag.Get("jksn"))
+                tag_name, tag_options, ok := parse_field_tag(typeof_value.Field(i))
                 if !ok {
-                    res, ok = self.find_map_key(generic_map, struct_field.Tag.Get("json"))
-                    if !ok {
-                        res, ok = self.find_map_key(generic_map, struct_field.Name)
-                    }
+                    continue
                 }
+                key, res, ok := self.find_map_key(generic_map, tag_name)
                 if ok {
+                    matched_keys[key] = true
+                    self.path = append(self.path, path_key(key))
                     self.fit_type(value.Elem().Field(i).Addr(), res)
+                    self.path = self.path[:len(self.path)-1]
+                } else if tag_options.has("required") {
+                    self.store_err(&MissingFieldError{ tag_name, typeof_value, path_string(self.path), self.mark_offset() })
+                }
+            }
+            if self.disallowunknown && len(matched_keys) != len(generic_map) {
+                for key := range generic_map {
+                    if !matched_keys[key] {
+                        self.path = append(self.path, path_key(key))
+                        self.store_err(&UnknownFieldError{ fmt.Sprintf("%v", key), typeof_value, path_string(self.path), self.mark_offset() })
+                        self.path = self.path[:len(self.path)-1]
+                    }
                 }
             }
         }
         default:
-            self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+            self.store_err(self.type_error(generic_value, value.Type()))
         }
     default:
-        self.store_err(&UnmarshalTypeError{ generic_reflect_value.String(), value.Type(), 0, })
+        self.store_err(self.type_error(generic_value, value.Type()))
     }
 }
 
-func (self *Decoder) find_map_key(generic_map map[interface{}]interface{}, keyname string) (res interface{}, ok bool) {
+func (self *Decoder) find_map_key(generic_map map[interface{}]interface{}, keyname string) (matched interface{}, res interface{}, ok bool) {
     if len(keyname) == 0 || keyname == "-" {
-        return nil, false
+        return nil, nil, false
     }
     for key, value := range generic_map {
         switch key.(type) {
         case string:
             if key.(string) == keyname {
-                return value, true
+                return key, value, true
             }
         case []byte:
             if bytes.Equal(key.([]byte), []byte(keyname)) {
-                return value, true
+                return key, value, true
             }
         default:
             if fmt.Sprintf("%v", key) == keyname {
-                return value, true
+                return key, value, true
             }
         }
     }
+    if self.exactcase {
+        return nil, nil, false
+    }
     for key, value := range generic_map {
         switch key.(type) {
         case string:
             if strings.EqualFold(key.(string), keyname) {
-                return value, true
+                return key, value, true
             }
         case []byte:
             if bytes.EqualFold(key.([]byte), []byte(keyname)) {
-                return value, true
+                return key, value, true
             }
         default:
             if strings.EqualFold(fmt.Sprintf("%v", key), keyname) {
-                return value, true
+                return key, value, true
             }
         }
     }
-    return nil, false
+    return nil, nil, false
 }
 
 func (self *Decoder) decode_int(size uint) *big.Int {
     if size == 1 {
-        int_byte, err := self.reader.ReadByte()
-        self.store_err(err)
-        self.readcount++
+        int_byte, _ := self.read_byte()
         return big.NewInt(int64(int_byte))
     } else if size == 2 {
         var buf [2]byte
-        n, err := io.ReadFull(self.reader, buf[:])
-        self.store_err(err)
-        self.readcount += int64(n)
+        self.read_full(buf[:])
         return big.NewInt(int64(buf[0]) << 8 | int64(buf[1]))
     } else if size == 4 {
         var buf [4]byte
-        n, err := io.ReadFull(self.reader, buf[:])
-        self.store_err(err)
-        self.readcount += int64(n)
+        self.read_full(buf[:])
         return big.NewInt(int64(buf[0]) << 24 | int64(buf[1]) << 16 | int64(buf[2]) << 8 | int64(buf[3]))
     } else if size == 0 {
         result := new(big.Int)
         thisbyte := uint8(0xff)
         for thisbyte & 0x80 != 0 {
             var err error
-            thisbyte, err = self.reader.ReadByte()
-            self.store_err(err)
-            self.readcount++
+            thisbyte, err = self.read_byte()
             if err != nil {
                 return new(big.Int)
             }
@@ -1369,7 +2299,6 @@ func (self *Decoder) decode_int(size uint) *big.Int {
     } else {
         panic("jksn: size not in (1, 2, 4, 0)")
     }
-    return new(big.Int)
 }
 
 func (self *Decoder) unsigned_to_signed(x *big.Int, bits uint) *big.Int {
@@ -1384,9 +2313,50 @@ func (self *Decoder) store_err(err error) error {
     if self.firsterr == nil {
         self.firsterr = err
     }
+    if self.lenient {
+        self.errs = append(self.errs, err)
+    }
     return self.firsterr
 }
 
+// store_fatal records an error after which the stream cannot be read any
+// further; the Decoder stays at the offending position.
+func (self *Decoder) store_fatal(err error) {
+    self.store_err(err)
+    if self.fatalerr == nil {
+        self.fatalerr = err
+    }
+}
+
+func (self *Decoder) stopped() bool {
+    return self.fatalerr != nil || (!self.lenient && self.firsterr != nil)
+}
+
+func path_string(path []string) string {
+    return "$" + strings.Join(path, "")
+}
+
+func path_index(index int) string {
+    return "[" + strconv.Itoa(index) + "]"
+}
+
+func path_key(key interface{}) string {
+    if key_str, ok := key.(string); ok {
+        is_identifier := len(key_str) != 0
+        for i, c := range key_str {
+            if !(c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i != 0 && c >= '0' && c <= '9')) {
+                is_identifier = false
+                break
+            }
+        }
+        if is_identifier {
+            return "." + key_str
+        }
+        return "[" + strconv.Quote(key_str) + "]"
+    }
+    return "[" + fmt.Sprintf("%v", key) + "]"
+}
+
 func utf8_to_utf16le(utf8str string) []byte {
     utf16str := utf16.Encode([]rune(utf8str))
     utf16lestr := make([]byte, len(utf16str)*2)
@@ -1398,11 +2368,8 @@ func utf8_to_utf16le(utf8str string) []byte {
 }
 
 func utf16le_to_utf8(utf16lestr []byte) string {
-    if (len(utf16lestr) & 0x1) != 0 {
-        panic("jksn: len(utf16lestr) not even")
-    }
     utf16str := make([]uint16, len(utf16lestr)/2)
-    for i, j := 0, 0; i < len(utf16lestr); i, j = i+2, j+1 {
+    for i, j := 0, 0; i+1 < len(utf16lestr); i, j = i+2, j+1 {
         utf16str[j] = uint16(utf16lestr[i]) + (uint16(utf16lestr[i+1]) << 8)
     }
     return string(utf16.Decode(utf16str))
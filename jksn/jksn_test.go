@@ -0,0 +1,88 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+ 
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+ 
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "math/big"
+    "reflect"
+    "testing"
+)
+
+func TestDeltaIntegers(t *testing.T) {
+    // 1000, then deltas of -100, -1000 and -1000000
+    var result []int64
+    if err := Unmarshal([]byte("jk!\x84\x1c\x03\xe8\xdd\x9c\xdc\xfc\x18\xdb\xff\xf0\xbd\xc0"), &result); err != nil {
+        t.Fatal(err)
+    }
+    if expected := []int64{ 1000, 900, -100, -1000100 }; !reflect.DeepEqual(result, expected) {
+        t.Errorf("decoded %v, expected %v", result, expected)
+    }
+    values := []int64{ 1000, 900, 1000, 70000, 1000, -3000000, 1 << 40, 1 << 40 - 100000, 1 << 40 + 3, -1 << 40, 0 }
+    data, err := Marshal(values)
+    if err != nil {
+        t.Fatal(err)
+    }
+    result = nil
+    if err := Unmarshal(data, &result); err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(result, values) {
+        t.Errorf("% x decoded as %v, expected %v", data, result, values)
+    }
+}
+
+func TestEncodeBigInt(t *testing.T) {
+    number := new(big.Int).Lsh(big.NewInt(1), 70)
+    if _, err := Marshal([]*big.Int{ number, number }); err != nil {
+        t.Fatal(err)
+    }
+    if expected := new(big.Int).Lsh(big.NewInt(1), 70); number.Cmp(expected) != 0 {
+        t.Errorf("Marshal changed its argument to %v", number)
+    }
+}
+
+func TestShortStringHash(t *testing.T) {
+    // "0" replaces "alpha28" in the hash tables of the decoder, so the
+    // second "alpha28" must not be written as a reference
+    strings := []string{ "alpha28", "0", "alpha28" }
+    data, err := Marshal(strings)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var result []string
+    if err := Unmarshal(data, &result); err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(result, strings) {
+        t.Errorf("% x decoded as %q", data, result)
+    }
+    blobs := [][]byte{ []byte("alpha28"), []byte("0"), []byte("alpha28") }
+    data, err = Marshal(blobs)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var blob_result [][]byte
+    if err := Unmarshal(data, &blob_result); err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(blob_result, blobs) {
+        t.Errorf("% x decoded as %q", data, blob_result)
+    }
+}
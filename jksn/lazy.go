@@ -0,0 +1,242 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "errors"
+    "math/big"
+)
+
+// LazyValue is a value of a JKSN document whose arrays and objects are only
+// parsed when their items are first accessed. It keeps the bytes of the
+// document, and for every parsed container the hash tables and last integer
+// at each of its items, so that a subtree decoded lazily matches what an
+// eager Decode of the whole document would produce.
+//
+// Like Value, accessors never panic and missing items are nil.
+type LazyValue struct {
+    doc         *lazy_document
+    offset      int64
+    state       index_state
+    lastint     *big.Int
+    control     uint8
+    children    *Index
+    keys        map[interface{}]int
+    eager       *Value
+    err         error
+}
+
+type lazy_document struct {
+    data        []byte
+    base        int64
+    options     *Decoder
+}
+
+// DecodeLazy reads the next JKSN document from the stream, but only records
+// where its values are. The returned LazyValue decodes parts of it on demand
+// using the options of this Decoder.
+func (self *Decoder) DecodeLazy() (*LazyValue, error) {
+    if err := self.begin_document(); err != nil {
+        return nil, err
+    }
+    start := self.readcount
+    state := index_state{ self.texthash, self.blobhash }
+    var lastint *big.Int
+    if self.lastint != nil {
+        lastint = new(big.Int).Set(self.lastint)
+    }
+    self.capture = new(bytes.Buffer)
+    self.skip_top_value()
+    data := self.capture.Bytes()
+    self.capture = nil
+    if err := self.result_err(); err != nil {
+        return nil, err
+    }
+    doc := &lazy_document{ data, start, self.derive(nil) }
+    return doc.value(0, state, lastint), nil
+}
+
+func (self *lazy_document) value(offset int64, state index_state, lastint *big.Int) *LazyValue {
+    result := &LazyValue{ doc: self, offset: offset, state: state, lastint: lastint }
+    for i := offset; i < int64(len(self.data)); i++ {
+        if self.data[i] != 0xca {
+            result.control = self.data[i]
+            break
+        }
+    }
+    return result
+}
+
+// decoder returns a Decoder positioned at offset with the given state.
+func (self *lazy_document) decoder(offset int64, state index_state, lastint *big.Int) *Decoder {
+    result := self.options.derive(bytes.NewReader(self.data[offset:]))
+    result.readcount = self.base + offset
+    result.texthash, result.blobhash = state.texthash, state.blobhash
+    if lastint != nil {
+        result.lastint = new(big.Int).Set(lastint)
+    }
+    return result
+}
+
+// parse records where the items of a container are, or decodes any other
+// value eagerly. It reports whether the value is usable.
+func (self *LazyValue) parse() bool {
+    if self == nil {
+        return false
+    }
+    if self.children != nil || self.eager != nil || self.err != nil {
+        return self.err == nil
+    }
+    if !is_container(self.control) {
+        self.eager = new(Value)
+        self.err = self.Decode(self.eager)
+        return self.err == nil
+    }
+    decoder := self.doc.decoder(self.offset, self.state, self.lastint)
+    builder := &index_builder{ decoder, &Index{ lookup: make(map[string]int), base: self.state }, self.state }
+    builder.walk("", 1)
+    if self.err = decoder.result_err(); self.err != nil {
+        return false
+    }
+    builder.result.build_checkpoints()
+    self.children = builder.result
+    if self.control & 0xf0 == 0x90 {
+        self.keys = make(map[interface{}]int, len(self.children.entries))
+        for i, entry := range self.children.entries {
+            self.keys[normalize_key(entry.key)] = i
+        }
+    }
+    return true
+}
+
+func (self *LazyValue) child(i int) *LazyValue {
+    entry := &self.children.entries[i]
+    return self.doc.value(entry.offset - self.doc.base, self.children.state(i), entry.lastint)
+}
+
+// Err returns the error which stopped parsing this value, if any.
+func (self *LazyValue) Err() error {
+    if self == nil {
+        return errors.New("jksn: missing value")
+    }
+    self.parse()
+    return self.err
+}
+
+// Kind returns the kind of the value, decoding it first unless it is an
+// array or an object.
+func (self *LazyValue) Kind() Kind {
+    switch {
+    case self == nil:
+        return KindUndefined
+    case self.control & 0xf0 == 0x80 || self.control == 0xc8:
+        return KindArray
+    case self.control & 0xf0 == 0x90:
+        return KindObject
+    }
+    self.parse()
+    return self.eager.Kind()
+}
+
+func (self *LazyValue) Len() int {
+    if !self.parse() {
+        return 0
+    }
+    if self.eager != nil {
+        return self.eager.Len()
+    }
+    return len(self.children.entries)
+}
+
+func (self *LazyValue) Index(index int) *LazyValue {
+    if !self.parse() {
+        return nil
+    }
+    if self.eager != nil {
+        return self.eager_child(self.eager.Index(index))
+    }
+    if self.keys != nil || index < 0 || index >= len(self.children.entries) {
+        return nil
+    }
+    return self.child(index)
+}
+
+func (self *LazyValue) Get(key interface{}) *LazyValue {
+    if !self.parse() {
+        return nil
+    }
+    if self.eager != nil {
+        return self.eager_child(self.eager.Get(key))
+    }
+    i, ok := self.keys[normalize_key(key)]
+    if !ok {
+        return nil
+    }
+    return self.child(i)
+}
+
+// Keys returns the keys of an object in the order they appear in the stream.
+func (self *LazyValue) Keys() []interface{} {
+    if !self.parse() {
+        return nil
+    }
+    if self.eager != nil {
+        return self.eager.Keys()
+    }
+    if self.keys == nil {
+        return nil
+    }
+    result := make([]interface{}, len(self.children.entries))
+    for i, entry := range self.children.entries {
+        result[i] = normalize_key(entry.key)
+    }
+    return result
+}
+
+// Decode decodes the value into obj, like Decoder.Decode.
+func (self *LazyValue) Decode(obj interface{}) error {
+    if self == nil {
+        return errors.New("jksn: missing value")
+    }
+    if self.offset < 0 {
+        data, err := Marshal(self.eager)
+        if err != nil {
+            return err
+        }
+        return self.doc.options.derive(bytes.NewReader(data)).Decode(obj)
+    }
+    return self.doc.decoder(self.offset, self.state, self.lastint).decode_document(obj)
+}
+
+// Value decodes the value into a Value tree.
+func (self *LazyValue) Value() (*Value, error) {
+    result := new(Value)
+    return result, self.Decode(result)
+}
+
+// eager_child wraps an item of a value which had to be decoded eagerly, such
+// as a row-col swapped array. It has no offset of its own in the document.
+func (self *LazyValue) eager_child(value *Value) *LazyValue {
+    if value == nil {
+        return nil
+    }
+    return &LazyValue{ doc: self.doc, offset: -1, eager: value }
+}
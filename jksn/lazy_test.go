@@ -0,0 +1,123 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+ 
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+ 
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "io"
+    "math/rand"
+    "testing"
+)
+
+// materialize builds a Value from a LazyValue item by item, visiting the
+// items of containers backwards if reverse is set.
+func materialize(t *testing.T, lazy *LazyValue, reverse bool) *Value {
+    var result *Value
+    switch lazy.Kind() {
+    case KindArray: {
+        items := make([]*Value, lazy.Len())
+        for i := range items {
+            if reverse {
+                i = len(items) - 1 - i
+            }
+            items[i] = materialize(t, lazy.Index(i), reverse)
+        }
+        result = NewArray(items...)
+    }
+    case KindObject: {
+        result = NewObject()
+        keys := lazy.Keys()
+        for i := range keys {
+            if reverse {
+                i = len(keys) - 1 - i
+            }
+            result.Set(keys[i], materialize(t, lazy.Get(keys[i]), reverse))
+        }
+    }
+    default: {
+        var err error
+        if result, err = lazy.Value(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    }
+    if err := lazy.Err(); err != nil {
+        t.Fatal(err)
+    }
+    return result
+}
+
+// check_lazy compares the documents of a stream decoded lazily, item by
+// item and as a whole, with those decoded eagerly.
+func check_lazy(t *testing.T, stream []byte) {
+    eager := NewDecoder(bytes.NewReader(stream))
+    lazy := NewDecoder(bytes.NewReader(stream))
+    for i := 0; ; i++ {
+        expected := new(Value)
+        err := eager.Decode(expected)
+        document, lazy_err := lazy.DecodeLazy()
+        if err == io.EOF && lazy_err == io.EOF {
+            return
+        } else if err != nil || lazy_err != nil {
+            t.Fatalf("document %d: Decode returned %v, DecodeLazy returned %v", i, err, lazy_err)
+        }
+        whole, err := document.Value()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !whole.Equal(expected) {
+            t.Errorf("document %d: got %v, want %v", i, whole.Interface(), expected.Interface())
+        }
+        if result := materialize(t, document, i % 2 == 1); !result.Equal(expected) {
+            t.Errorf("document %d item by item: got %v, want %v", i, result.Interface(), expected.Interface())
+        }
+    }
+}
+
+func TestDecodeLazy(t *testing.T) {
+    check_lazy(t, skip_stream(t))
+    check_lazy(t, index_stream(t))
+    check_lazy(t, []byte("jk!\x1c\x03\xe8jk!\x82\xdd\x9c\x82\xdc\xfc\x18\x41ajk!\x92\x41a\xdb\xff\xf0\xbd\xc0\x3c\x61\xd0"))
+    // Random documents with swapped arrays, which are decoded eagerly
+    rows := func(i int) []map[string]interface{} {
+        return []map[string]interface{}{ { "id": i, "name": "alpha" }, { "id": i+1, "name": "beta" } }
+    }
+    if data, err := Marshal(rows(0)); err != nil || data[3] & 0xf0 != 0xa0 {
+        t.Fatalf("rows are not swapped: % x", data)
+    }
+    random := rand.New(rand.NewSource(1))
+    var stream bytes.Buffer
+    encoder := NewEncoder(&stream)
+    for i := 0; i < 300; i++ {
+        value := random_value(random, 0)
+        if i % 10 == 0 {
+            value = NewArray(value, NewString("row"), NewInt(int64(i)))
+        }
+        if err := encoder.Encode(value); err != nil {
+            t.Fatal(err)
+        }
+        if i % 50 == 0 {
+            if err := encoder.Encode(map[string]interface{}{ "rows": rows(i), "name": "alpha" }); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    check_lazy(t, stream.Bytes())
+}
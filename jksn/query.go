@@ -0,0 +1,719 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "errors"
+    "io"
+    "iter"
+    "math/big"
+    "strconv"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// Filter is a compiled query expression, see Query.
+type Filter struct {
+    terms   []query_term
+}
+
+// query_term is one stage of a pipeline: a path, or a condition selecting
+// which values pass.
+type query_term struct {
+    path    []query_step
+    select_ *query_condition
+}
+
+type query_step struct {
+    kind    int
+    key     string
+    index   int
+    // Bounds of a slice; has_start and has_end tell whether they were given
+    start, end          int
+    has_start, has_end  bool
+}
+
+const (
+    step_field = iota
+    step_index
+    step_slice
+    step_iterate
+)
+
+type query_condition struct {
+    op          string
+    // Operands of "and", "or" and "not"
+    left, right *query_condition
+    // Operands of comparisons, and the path of a truth test
+    path        *query_term
+    other       *query_term
+    literal     *Value
+    other_literal   *Value
+}
+
+// Query compiles a jq-like expression. It is a pipeline of terms separated
+// by "|", each taking the values produced by the one before:
+//
+//     .                   the value itself
+//     .name, ."any key"   an object key; integer object keys match too
+//     .[2], .[-1]         an array item, counting from the end if negative
+//     .[1:3], .[2:]       a slice of an array, as a value per item
+//     .[]                 every item of an array or value of an object
+//     .users[].email      steps chained into a path
+//     select(condition)   the value, if the condition holds for it
+//
+// Conditions compare a path or a JSON literal with ==, !=, <, <=, > or >=,
+// and combine with and, or, not and parentheses, as in
+//
+//     .items[] | select(.price >= 10 and .tags[] == "sale") | .name
+//
+// A path alone tests that it finds a value which is not null or false. A
+// comparison holds if any value its paths find satisfies it; numbers compare
+// by value whatever their encoding. Keys and items which do not exist give
+// no value rather than null, so missing fields are skipped.
+func Query(expr string) (*Filter, error) {
+    parser := &query_parser{ tokens: nil, expr: expr }
+    if err := parser.tokenize(); err != nil {
+        return nil, err
+    }
+    result := &Filter{}
+    for {
+        term, err := parser.term()
+        if err != nil {
+            return nil, err
+        }
+        result.terms = append(result.terms, term)
+        if parser.peek() == "" {
+            return result, nil
+        } else if parser.peek() != "|" {
+            return nil, parser.error("expected |")
+        }
+        parser.next()
+    }
+}
+
+// Run evaluates the filter on each remaining document of the stream, and
+// yields the values it produces. Documents are decoded lazily, so only the
+// parts the filter looks at are decoded. Decoding stops at the first error.
+//
+// Each document is held in memory whole while the filter runs on it, as
+// DecodeLazy keeps its bytes, so memory use is bounded by the largest
+// document rather than by the stream. A stream of many records, such as
+// encode -ndjson writes, is cheap to query; one huge document is not.
+func (self *Filter) Run(decoder *Decoder) iter.Seq2[*Value, error] {
+    return func(yield func(*Value, error) bool) {
+        for {
+            document, err := decoder.DecodeLazy()
+            if err == io.EOF {
+                return
+            } else if err != nil {
+                yield(nil, err)
+                return
+            }
+            for node, err := range self.eval(lazy_node{ document }) {
+                var value *Value
+                if err == nil {
+                    value, err = node.value()
+                }
+                if !yield(value, err) || err != nil {
+                    return
+                }
+            }
+        }
+    }
+}
+
+// Eval evaluates the filter on a Value tree and returns the values it
+// produces.
+func (self *Filter) Eval(value *Value) []*Value {
+    var result []*Value
+    for node := range self.eval(tree_node{ value }) {
+        item, _ := node.value()
+        result = append(result, item)
+    }
+    return result
+}
+
+// eval yields the nodes the filter produces, or the error which stopped a
+// select from deciding whether input passes.
+func (self *Filter) eval(input query_node) iter.Seq2[query_node, error] {
+    return func(yield func(query_node, error) bool) {
+        eval_terms(self.terms, input, yield)
+    }
+}
+
+// eval_terms passes each value the first term produces for input through
+// the rest. It returns false once yield asks to stop.
+func eval_terms(terms []query_term, input query_node, yield func(query_node, error) bool) bool {
+    if len(terms) == 0 {
+        return yield(input, nil)
+    }
+    term := &terms[0]
+    if term.select_ != nil {
+        if holds, err := term.select_.holds(input); err != nil {
+            return yield(nil, err)
+        } else if holds {
+            return eval_terms(terms[1:], input, yield)
+        }
+        return true
+    }
+    return eval_path(term.path, input, func(node query_node) bool {
+        return eval_terms(terms[1:], node, yield)
+    })
+}
+
+func eval_path(path []query_step, input query_node, yield func(query_node) bool) bool {
+    if len(path) == 0 {
+        return yield(input)
+    }
+    step := &path[0]
+    next := func(node query_node) bool {
+        if node == nil {
+            return true
+        }
+        return eval_path(path[1:], node, yield)
+    }
+    switch step.kind {
+    case step_field: {
+        if input.Kind() != KindObject {
+            return true
+        }
+        item := input.get(step.key)
+        if item == nil {
+            if key, ok := new(big.Int).SetString(step.key, 10); ok && key.String() == step.key {
+                item = input.get(normalize_key(key))
+            }
+        }
+        return next(item)
+    }
+    case step_index: {
+        if input.Kind() != KindArray {
+            return true
+        }
+        index := step.index
+        if index < 0 {
+            index += input.Len()
+        }
+        if index < 0 || index >= input.Len() {
+            return true
+        }
+        return next(input.index(index))
+    }
+    case step_slice: {
+        if input.Kind() != KindArray {
+            return true
+        }
+        length := input.Len()
+        start, end := slice_bound(step.start, step.has_start, 0, length), slice_bound(step.end, step.has_end, length, length)
+        for i := start; i < end; i++ {
+            if !next(input.index(i)) {
+                return false
+            }
+        }
+        return true
+    }
+    default:
+        switch input.Kind() {
+        case KindArray:
+            for i := 0; i < input.Len(); i++ {
+                if !next(input.index(i)) {
+                    return false
+                }
+            }
+        case KindObject:
+            for _, key := range input.keys() {
+                if !next(input.get(key)) {
+                    return false
+                }
+            }
+        }
+        return true
+    }
+}
+
+func slice_bound(bound int, given bool, fallback int, length int) int {
+    if !given {
+        return fallback
+    }
+    if bound < 0 {
+        bound += length
+    }
+    return max(0, min(bound, length))
+}
+
+// holds reports whether input passes the condition. It fails if a value the
+// condition looks at cannot be decoded.
+func (self *query_condition) holds(input query_node) (bool, error) {
+    switch self.op {
+    case "and": {
+        holds, err := self.left.holds(input)
+        if err != nil || !holds {
+            return false, err
+        }
+        return self.right.holds(input)
+    }
+    case "or": {
+        holds, err := self.left.holds(input)
+        if err != nil || holds {
+            return holds, err
+        }
+        return self.right.holds(input)
+    }
+    case "not": {
+        holds, err := self.left.holds(input)
+        return err == nil && !holds, err
+    }
+    case "":
+        return any_value(self.path, self.literal, input, func(value *Value) (bool, error) {
+            return value.Kind() != KindNull && value.Kind() != KindUndefined && !(value.Kind() == KindBool && !value.Bool()), nil
+        })
+    default:
+        return any_value(self.path, self.literal, input, func(left *Value) (bool, error) {
+            return any_value(self.other, self.other_literal, input, func(right *Value) (bool, error) {
+                return compare_holds(self.op, left, right), nil
+            })
+        })
+    }
+}
+
+// any_value reports whether test holds for the literal, or for any value
+// path finds in input. It stops at the first value which cannot be decoded.
+func any_value(path *query_term, literal *Value, input query_node, test func(*Value) (bool, error)) (bool, error) {
+    if path == nil {
+        return test(literal)
+    }
+    found := false
+    var err error
+    eval_path(path.path, input, func(node query_node) bool {
+        var value *Value
+        if value, err = node.value(); err == nil {
+            found, err = test(value)
+        }
+        return !found && err == nil
+    })
+    return found, err
+}
+
+// compare_holds compares numbers by value and strings by bytes. Other kinds
+// are only equal or unequal.
+func compare_holds(op string, left *Value, right *Value) bool {
+    order, ordered := 0, false
+    switch {
+    case is_number(left) && is_number(right): {
+        left_float, left_nan := number_value(left)
+        right_float, right_nan := number_value(right)
+        if left_nan || right_nan {
+            return op == "!="
+        }
+        order, ordered = left_float.Cmp(right_float), true
+    }
+    case left.Kind() == KindString && right.Kind() == KindString:
+        order, ordered = strings.Compare(left.Str(), right.Str()), true
+    case left.Equal(right):
+        order = 0
+    default:
+        return op == "!="
+    }
+    switch op {
+    case "==":
+        return order == 0
+    case "!=":
+        return order != 0
+    case "<":
+        return ordered && order < 0
+    case "<=":
+        return ordered && order <= 0
+    case ">":
+        return ordered && order > 0
+    default:
+        return ordered && order >= 0
+    }
+}
+
+func is_number(value *Value) bool {
+    return value.Kind() == KindInt || value.Kind() == KindFloat
+}
+
+func number_value(value *Value) (*big.Float, bool) {
+    if value.Kind() == KindInt {
+        return new(big.Float).SetInt(value.BigInt()), false
+    }
+    return exact_float(value.scalar)
+}
+
+// query_node is what a Filter walks: a LazyValue when running over a stream,
+// or a Value.
+type query_node interface {
+    Kind() Kind
+    Len() int
+    index(i int) query_node
+    get(key interface{}) query_node
+    keys() []interface{}
+    value() (*Value, error)
+}
+
+type lazy_node struct {
+    *LazyValue
+}
+
+func (self lazy_node) index(i int) query_node {
+    if item := self.Index(i); item != nil {
+        return lazy_node{ item }
+    }
+    return nil
+}
+
+func (self lazy_node) get(key interface{}) query_node {
+    if item := self.Get(key); item != nil {
+        return lazy_node{ item }
+    }
+    return nil
+}
+
+func (self lazy_node) keys() []interface{} {
+    return self.Keys()
+}
+
+func (self lazy_node) value() (*Value, error) {
+    return self.Value()
+}
+
+type tree_node struct {
+    *Value
+}
+
+func (self tree_node) index(i int) query_node {
+    if item := self.Index(i); item != nil {
+        return tree_node{ item }
+    }
+    return nil
+}
+
+func (self tree_node) get(key interface{}) query_node {
+    if item := self.Get(key); item != nil {
+        return tree_node{ item }
+    }
+    return nil
+}
+
+func (self tree_node) keys() []interface{} {
+    return self.Keys()
+}
+
+func (self tree_node) value() (*Value, error) {
+    return self.Value, nil
+}
+
+type query_parser struct {
+    expr    string
+    tokens  []query_token
+    pos     int
+}
+
+type query_token struct {
+    text    string
+    offset  int
+    // The value of a string or number literal
+    literal *Value
+}
+
+func (self *query_parser) error(message string) error {
+    offset := len(self.expr)
+    if self.pos < len(self.tokens) {
+        offset = self.tokens[self.pos].offset
+    }
+    return errors.New("jksn: query " + strconv.Quote(self.expr) + " at offset " + strconv.Itoa(offset) + ": " + message)
+}
+
+func (self *query_parser) tokenize() error {
+    for i := 0; i < len(self.expr); {
+        c := self.expr[i]
+        switch {
+        case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+            i++
+        case c == '"': {
+            quoted, err := strconv.QuotedPrefix(self.expr[i:])
+            if err != nil {
+                return errors.New("jksn: query " + strconv.Quote(self.expr) + " at offset " + strconv.Itoa(i) + ": bad string")
+            }
+            text, _ := strconv.Unquote(quoted)
+            self.tokens = append(self.tokens, query_token{ "\"", i, NewString(text) })
+            i += len(quoted)
+        }
+        case c == '-' || (c >= '0' && c <= '9'): {
+            end := i + 1
+            for end < len(self.expr) && (strings.IndexByte("0123456789.eE", self.expr[end]) >= 0 || strings.IndexByte("eE", self.expr[end-1]) >= 0 && strings.IndexByte("+-", self.expr[end]) >= 0) {
+                end++
+            }
+            number := parse_number(self.expr[i:end])
+            if number == nil {
+                return errors.New("jksn: query " + strconv.Quote(self.expr) + " at offset " + strconv.Itoa(i) + ": bad number")
+            }
+            self.tokens = append(self.tokens, query_token{ "0", i, number })
+            i = end
+        }
+        case is_identifier_start(self.expr[i:]): {
+            end := i
+            for end < len(self.expr) {
+                r, size := utf8.DecodeRuneInString(self.expr[end:])
+                if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+                    break
+                }
+                end += size
+            }
+            self.tokens = append(self.tokens, query_token{ self.expr[i:end], i, nil })
+            i = end
+        }
+        default: {
+            length := 1
+            if i + 1 < len(self.expr) && strings.Contains("==,!=,<=,>=", self.expr[i:i+2]) {
+                length = 2
+            }
+            if length == 1 && strings.IndexByte(".[]:|()<>", c) < 0 {
+                r, _ := utf8.DecodeRuneInString(self.expr[i:])
+                return errors.New("jksn: query " + strconv.Quote(self.expr) + " at offset " + strconv.Itoa(i) + ": unexpected " + strconv.QuoteRune(r))
+            }
+            self.tokens = append(self.tokens, query_token{ self.expr[i:i+length], i, nil })
+            i += length
+        }
+        }
+    }
+    return nil
+}
+
+// parse_number parses an integer of any size, or a float. It returns nil if
+// text is neither.
+func parse_number(text string) *Value {
+    if integer, ok := new(big.Int).SetString(text, 10); ok {
+        return NewBigInt(integer)
+    }
+    float, err := strconv.ParseFloat(text, 64)
+    if err != nil {
+        return nil
+    }
+    return NewFloat(float)
+}
+
+func (self *query_parser) peek() string {
+    if self.pos < len(self.tokens) {
+        return self.tokens[self.pos].text
+    }
+    return ""
+}
+
+func (self *query_parser) next() query_token {
+    token := self.tokens[self.pos]
+    self.pos++
+    return token
+}
+
+func (self *query_parser) is_identifier() bool {
+    return is_identifier_start(self.peek())
+}
+
+// is_identifier_start reports whether text starts with a letter or _.
+func is_identifier_start(text string) bool {
+    r, _ := utf8.DecodeRuneInString(text)
+    return r == '_' || unicode.IsLetter(r)
+}
+
+func (self *query_parser) term() (query_term, error) {
+    if self.peek() == "select" {
+        self.next()
+        if self.peek() != "(" {
+            return query_term{}, self.error("expected ( after select")
+        }
+        self.next()
+        condition, err := self.condition()
+        if err != nil {
+            return query_term{}, err
+        }
+        if self.peek() != ")" {
+            return query_term{}, self.error("expected )")
+        }
+        self.next()
+        return query_term{ select_: condition }, nil
+    }
+    path, err := self.path()
+    return query_term{ path: path }, err
+}
+
+// path parses "." followed by any number of steps.
+func (self *query_parser) path() ([]query_step, error) {
+    if self.peek() != "." {
+        return nil, self.error("expected a path starting with .")
+    }
+    self.next()
+    result := []query_step{}
+    // Right after a dot, a key may follow without brackets
+    after_dot := true
+    for {
+        switch {
+        case after_dot && self.is_identifier():
+            result = append(result, query_step{ kind: step_field, key: self.next().text })
+        case after_dot && self.peek() == "\"":
+            result = append(result, query_step{ kind: step_field, key: self.next().literal.Str() })
+        case self.peek() == "[": {
+            step, err := self.bracket()
+            if err != nil {
+                return nil, err
+            }
+            result = append(result, step)
+        }
+        case self.peek() == "." && !after_dot:
+            self.next()
+            after_dot = true
+            continue
+        default:
+            if after_dot && len(result) != 0 {
+                return nil, self.error("expected a key or [ after .")
+            }
+            return result, nil
+        }
+        after_dot = false
+    }
+}
+
+// bracket parses [], [index], [start:end] or ["key"].
+func (self *query_parser) bracket() (query_step, error) {
+    self.next()
+    var step query_step
+    switch {
+    case self.peek() == "]":
+        step.kind = step_iterate
+    case self.peek() == "\"":
+        step = query_step{ kind: step_field, key: self.next().literal.Str() }
+    default: {
+        var err error
+        step.kind = step_index
+        if self.peek() != ":" {
+            if step.start, err = self.integer(); err != nil {
+                return step, err
+            }
+            step.index, step.has_start = step.start, true
+        }
+        if self.peek() == ":" {
+            self.next()
+            step.kind = step_slice
+            if self.peek() != "]" {
+                if step.end, err = self.integer(); err != nil {
+                    return step, err
+                }
+                step.has_end = true
+            }
+        } else if !step.has_start {
+            return step, self.error("expected an index")
+        }
+    }
+    }
+    if self.peek() != "]" {
+        return step, self.error("expected ]")
+    }
+    self.next()
+    return step, nil
+}
+
+func (self *query_parser) integer() (int, error) {
+    if self.peek() != "0" || self.tokens[self.pos].literal.Kind() != KindInt {
+        return 0, self.error("expected an integer")
+    }
+    number := self.tokens[self.pos].literal.BigInt()
+    if !number.IsInt64() || int64(int(number.Int64())) != number.Int64() {
+        return 0, self.error("index out of range")
+    }
+    self.next()
+    return int(number.Int64()), nil
+}
+
+func (self *query_parser) condition() (*query_condition, error) {
+    left, err := self.conjunction()
+    for err == nil && self.peek() == "or" {
+        self.next()
+        var right *query_condition
+        if right, err = self.conjunction(); err == nil {
+            left = &query_condition{ op: "or", left: left, right: right }
+        }
+    }
+    return left, err
+}
+
+func (self *query_parser) conjunction() (*query_condition, error) {
+    left, err := self.negation()
+    for err == nil && self.peek() == "and" {
+        self.next()
+        var right *query_condition
+        if right, err = self.negation(); err == nil {
+            left = &query_condition{ op: "and", left: left, right: right }
+        }
+    }
+    return left, err
+}
+
+func (self *query_parser) negation() (*query_condition, error) {
+    switch self.peek() {
+    case "not": {
+        self.next()
+        operand, err := self.negation()
+        return &query_condition{ op: "not", left: operand }, err
+    }
+    case "(": {
+        self.next()
+        result, err := self.condition()
+        if err == nil && self.peek() != ")" {
+            err = self.error("expected )")
+        }
+        if err == nil {
+            self.next()
+        }
+        return result, err
+    }
+    }
+    result := new(query_condition)
+    var err error
+    if result.path, result.literal, err = self.operand(); err != nil {
+        return nil, err
+    }
+    switch self.peek() {
+    case "==", "!=", "<", "<=", ">", ">=":
+        result.op = self.next().text
+        result.other, result.other_literal, err = self.operand()
+    default:
+        if result.path == nil {
+            err = self.error("expected a comparison")
+        }
+    }
+    return result, err
+}
+
+// operand parses a path or a literal.
+func (self *query_parser) operand() (*query_term, *Value, error) {
+    switch self.peek() {
+    case "\"", "0":
+        return nil, self.next().literal, nil
+    case "true", "false":
+        return nil, NewBool(self.next().text == "true"), nil
+    case "null":
+        self.next()
+        return nil, NewNull(), nil
+    }
+    path, err := self.path()
+    return &query_term{ path: path }, nil, err
+}
@@ -0,0 +1,171 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+ 
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+ 
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "encoding/json"
+    "strings"
+    "testing"
+)
+
+const query_document = `{"users": [{"name": "ann", "age": 31, "tags": ["admin", "sale"]}, {"name": "bob", "age": 25.0, "tags": []}, {"name": "cy", "email": null}], "count": 3}`
+
+// check_query runs expr over the documents of stream and compares the values
+// it yields, as JSON, with want.
+func check_query(t *testing.T, expr string, stream []byte, want ...string) {
+    filter, err := Query(expr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var got []string
+    for value, err := range filter.Run(NewDecoder(bytes.NewReader(stream))) {
+        if err != nil {
+            t.Fatalf("%s: %v", expr, err)
+        }
+        text, _ := json.Marshal(value)
+        got = append(got, string(text))
+    }
+    if strings.Join(got, " ") != strings.Join(want, " ") {
+        t.Errorf("%s: got %v, want %v", expr, got, want)
+    }
+}
+
+// check_eval is check_query with Eval over a decoded document.
+func check_eval(t *testing.T, expr string, document *Value, want ...string) {
+    filter, err := Query(expr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var got []string
+    for _, value := range filter.Eval(document) {
+        text, _ := json.Marshal(value)
+        got = append(got, string(text))
+    }
+    if strings.Join(got, " ") != strings.Join(want, " ") {
+        t.Errorf("%s: Eval got %v, want %v", expr, got, want)
+    }
+}
+
+func query_stream(t *testing.T, text string) []byte {
+    var stream bytes.Buffer
+    if err := TranscodeFromJSON(&stream, strings.NewReader(text)); err != nil {
+        t.Fatal(err)
+    }
+    return stream.Bytes()
+}
+
+func TestQueryPath(t *testing.T) {
+    stream := query_stream(t, query_document)
+    document := new(Value)
+    if err := Unmarshal(stream, document); err != nil {
+        t.Fatal(err)
+    }
+    for _, test := range []struct {
+        expr    string
+        want    []string
+    }{
+        { ".count", []string{ "3" } },
+        { ".users[0].name", []string{ `"ann"` } },
+        { ".users[-1].name", []string{ `"cy"` } },
+        { ".users[].name", []string{ `"ann"`, `"bob"`, `"cy"` } },
+        { ".users[1:].name", []string{ `"bob"`, `"cy"` } },
+        { ".users[:-2].name", []string{ `"ann"` } },
+        { ".users[-2:5].name", []string{ `"bob"`, `"cy"` } },
+        { ".users[].tags[]", []string{ `"admin"`, `"sale"` } },
+        { `."users" | .[0] | .age`, []string{ "31" } },
+        { ".users[2].email", []string{ "null" } },
+        { ".users[5].name", nil },
+        { ".users[1].email", nil },
+        { ".count.name", nil },
+        { ".count[]", nil },
+    } {
+        check_query(t, test.expr, stream, test.want...)
+        check_eval(t, test.expr, document, test.want...)
+    }
+}
+
+func TestQueryFilter(t *testing.T) {
+    stream := query_stream(t, query_document)
+    document := new(Value)
+    if err := Unmarshal(stream, document); err != nil {
+        t.Fatal(err)
+    }
+    for _, test := range []struct {
+        expr    string
+        want    []string
+    }{
+        { ".users[] | select(.age >= 30) | .name", []string{ `"ann"` } },
+        // 25.0 is equal to the integer 25
+        { ".users[] | select(.age == 25) | .name", []string{ `"bob"` } },
+        { ".users[] | select(.age != 25) | .name", []string{ `"ann"` } },
+        { `.users[] | select(.tags[] == "sale") | .name`, []string{ `"ann"` } },
+        { ".users[] | select(.email) | .name", nil },
+        { ".users[] | select(not .age) | .name", []string{ `"cy"` } },
+        { `.users[] | select(.age < 30 or .name == "cy") | .name`, []string{ `"bob"`, `"cy"` } },
+        { `.users[] | select(.name != "ann" and (.age > 20)) | .name`, []string{ `"bob"` } },
+        { `.users[] | select("b" < .name) | .name`, []string{ `"bob"`, `"cy"` } },
+        { ".users[] | select(.email == null) | .name", []string{ `"cy"` } },
+        { ". | select(.count == 3) | .users[0].age", []string{ "31" } },
+    } {
+        check_query(t, test.expr, stream, test.want...)
+        check_eval(t, test.expr, document, test.want...)
+    }
+}
+
+func TestQueryNDJSON(t *testing.T) {
+    // TranscodeFromJSON keeps its hash tables and last integer across
+    // documents, so later records refer back to earlier ones
+    stream := query_stream(t, `{"id": 1000, "name": "ann", "tags": ["x"]}
+{"id": 1001, "name": "ann", "tags": ["y", "x"]}
+{"id": 1003, "name": "bob"}
+`)
+    if !bytes.Contains(stream, []byte{ 0x3c }) || !bytes.Contains(stream, []byte{ 0xd1 }) {
+        t.Fatalf("records do not share hash tables and delta integers: % x", stream)
+    }
+    check_query(t, ".id", stream, "1000", "1001", "1003")
+    check_query(t, `select(.name == "ann") | .id`, stream, "1000", "1001")
+    check_query(t, ".tags[-1]", stream, `"x"`, `"x"`)
+    check_query(t, `select(.tags[] == "y") | .name`, stream, `"ann"`)
+    check_query(t, "select(.id > 1001) | .name", stream, `"bob"`)
+
+    // Decoding stops at a truncated record, after yielding the ones before
+    filter, _ := Query(".id")
+    var got []string
+    var last_err error
+    for value, err := range filter.Run(NewDecoder(bytes.NewReader(stream[:len(stream)-2]))) {
+        if err != nil {
+            last_err = err
+            continue
+        }
+        got = append(got, value.BigInt().String())
+    }
+    if strings.Join(got, " ") != "1000 1001" || last_err == nil {
+        t.Errorf("truncated stream: got %v and error %v", got, last_err)
+    }
+}
+
+func TestQueryErrors(t *testing.T) {
+    for _, expr := range []string{ "", "users", ".users[", ".a | ", "select(.a ==)", `."a` } {
+        if _, err := Query(expr); err == nil {
+            t.Errorf("%q compiled", expr)
+        }
+    }
+}
@@ -0,0 +1,196 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "errors"
+    "reflect"
+    "strconv"
+    "sync"
+)
+
+// TypeTagStyle selects how the concrete type of a value stored in a
+// non-empty interface is recorded in a JKSN stream.
+type TypeTagStyle int
+
+const (
+    // Object with an extra type key, e.g. {"$type": "click", "x": 1}.
+    // Values which are not objects become {"$type": "name", "value": ...}
+    TypeTagKey TypeTagStyle = iota
+    // Two-element array ["name", value]
+    TypeTagPair
+)
+
+const default_type_key = "$type"
+
+var registry_lock sync.RWMutex
+var registry_types = make(map[string]reflect.Type)
+var registry_names = make(map[reflect.Type]string)
+
+// Register records the concrete type of prototype under name, so that values
+// of that type held in interface fields can be encoded with a type tag and
+// decoded back into the same type. Like gob.Register, it panics if either
+// the name or the type is already registered differently.
+func Register(name string, prototype interface{}) {
+    if prototype == nil {
+        panic("jksn: Register(nil)")
+    }
+    prototype_type := reflect.TypeOf(prototype)
+    registry_lock.Lock()
+    defer registry_lock.Unlock()
+    if registered, ok := registry_types[name]; ok && registered != prototype_type {
+        panic("jksn: registering duplicate types for " + strconv.Quote(name) + ": " + registered.String() + " != " + prototype_type.String())
+    }
+    if registered, ok := registry_names[prototype_type]; ok && registered != name {
+        panic("jksn: registering duplicate names for " + prototype_type.String() + ": " + strconv.Quote(registered) + " != " + strconv.Quote(name))
+    }
+    registry_types[name] = prototype_type
+    registry_names[prototype_type] = name
+}
+
+func registered_type(name string) (result reflect.Type, ok bool) {
+    registry_lock.RLock()
+    result, ok = registry_types[name]
+    registry_lock.RUnlock()
+    return
+}
+
+func registered_name(typ reflect.Type) (result string, ok bool) {
+    registry_lock.RLock()
+    result, ok = registry_names[typ]
+    registry_lock.RUnlock()
+    return
+}
+
+func (self *Encoder) SetTypeTag(style TypeTagStyle, key string) {
+    self.typetagstyle, self.typetagkey = style, key
+}
+
+func (self *Decoder) SetTypeTag(style TypeTagStyle, key string) {
+    self.typetagstyle, self.typetagkey = style, key
+}
+
+func type_tag_key(key string) string {
+    if key == "" {
+        return default_type_key
+    }
+    return key
+}
+
+// element_interface returns the value to encode for an element, field or map
+// value, wrapping it with a type tag when it is held in a non-empty interface
+// and its concrete type is registered. A nil pointer is written as null.
+func (self *Encoder) element_interface(value reflect.Value) interface{} {
+    if value.Kind() != reflect.Interface || value.IsNil() || value.Type().NumMethod() == 0 {
+        return value.Interface()
+    }
+    concrete := value.Elem()
+    if concrete.Kind() == reflect.Ptr && concrete.IsNil() {
+        // Nothing to tag, and a bare null decodes back to a nil interface
+        return nil
+    }
+    name, ok := registered_name(concrete.Type())
+    if !ok {
+        return concrete.Interface()
+    }
+    if self.typetagstyle == TypeTagPair {
+        return []interface{}{ name, concrete.Interface() }
+    }
+    key := type_tag_key(self.typetagkey)
+    inner := concrete
+    for inner.Kind() == reflect.Ptr && !inner.IsNil() {
+        inner = inner.Elem()
+    }
+    var result map[interface{}]interface{}
+    switch {
+    case inner.Kind() == reflect.Struct && !is_struct_scalar(inner.Interface()):
+        result = self.struct_to_map(inner.Interface())
+    case inner.Kind() == reflect.Map:
+        result = make(map[interface{}]interface{}, inner.Len()+1)
+        for _, map_key := range inner.MapKeys() {
+            result[map_key.Interface()] = self.element_interface(inner.MapIndex(map_key))
+        }
+    default:
+        result = map[interface{}]interface{}{ "value": concrete.Interface() }
+    }
+    result[key] = name
+    return result
+}
+
+func (self *Decoder) fit_registered(value reflect.Value, generic_value interface{}) {
+    var name string
+    var payload interface{}
+    // Path step to the payload, if it is not the value itself
+    var payload_step string
+    if self.typetagstyle == TypeTagPair {
+        generic_array, ok := generic_value.([]interface{})
+        if ok && len(generic_array) == 2 {
+            name, ok = generic_array[0].(string)
+            payload, payload_step = generic_array[1], path_index(1)
+        }
+        if !ok {
+            self.store_err(self.type_error_cause(generic_value, value.Type(), errors.New("expected a [type, value] pair")))
+            return
+        }
+    } else {
+        generic_map, ok := generic_value.(map[interface{}]interface{})
+        if ok {
+            name, ok = generic_map[type_tag_key(self.typetagkey)].(string)
+        }
+        if !ok {
+            self.store_err(self.type_error_cause(generic_value, value.Type(), errors.New("missing type key " + strconv.Quote(type_tag_key(self.typetagkey)))))
+            return
+        }
+        payload_map := make(map[interface{}]interface{}, len(generic_map)-1)
+        for key, item := range generic_map {
+            if key != type_tag_key(self.typetagkey) {
+                payload_map[key] = item
+            }
+        }
+        payload = payload_map
+        if registered, ok := registered_type(name); ok {
+            inner := registered
+            for inner.Kind() == reflect.Ptr {
+                inner = inner.Elem()
+            }
+            if inner.Kind() != reflect.Struct && inner.Kind() != reflect.Map || is_struct_scalar(reflect.Zero(inner).Interface()) {
+                payload, payload_step = payload_map["value"], path_key("value")
+            }
+        }
+    }
+    registered, ok := registered_type(name)
+    if !ok {
+        self.store_err(self.type_error_cause(generic_value, value.Type(), errors.New("unregistered type name " + strconv.Quote(name))))
+        return
+    }
+    if !registered.Implements(value.Type().Elem()) {
+        self.store_err(self.type_error_cause(generic_value, value.Type(), errors.New(registered.String() + " does not implement " + value.Type().Elem().String())))
+        return
+    }
+    result := reflect.New(registered)
+    if payload_step != "" {
+        self.path = append(self.path, payload_step)
+        self.fit_type(result, payload)
+        self.path = self.path[:len(self.path)-1]
+    } else {
+        self.fit_type(result, payload)
+    }
+    value.Elem().Set(result.Elem())
+}
@@ -0,0 +1,336 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "fmt"
+    "math/big"
+)
+
+// Skip reads the next JKSN document from the stream and discards it. No Go
+// values are built for it, except the strings, blobs and integers which the
+// hash tables and delta integers of later values may refer to.
+func (self *Decoder) Skip() error {
+    if err := self.begin_document(); err != nil {
+        return err
+    }
+    self.skip_top_value()
+    return self.result_err()
+}
+
+// skip_top_value skips a whole top-level value, see load_top_value.
+func (self *Decoder) skip_top_value() {
+    self.skip_value()
+    if self.stopped() && self.fatalerr == nil {
+        self.fatalerr = self.firsterr
+    }
+}
+
+// skip_value follows load_value, but only updates the decoder state. It
+// returns the control byte of the value skipped, so that the terminator of a
+// lengthless array can be recognized. Every control byte is passed to traced,
+// which describes it to the tracer of Disassemble and Analyze, if any.
+func (self *Decoder) skip_value() uint8 {
+    for {
+        if self.stopped() {
+            return 0
+        }
+        control, err := self.read_byte()
+        if err != nil {
+            return 0
+        }
+        self.valueoffset = self.readcount-1
+        switch control & 0xf0 {
+        case 0x00:
+            switch control {
+            case 0x00, 0x01, 0x02, 0x03:
+                self.traced(trace_value, control, 0, nil)
+                return control
+            case 0x0f:
+                self.traced(trace_value, control, 0, nil)
+                self.skip_values(1)
+                return control
+            }
+        case 0x10:
+            switch control {
+            default:
+                self.lastint = big.NewInt(int64(control & 0xf))
+            case 0x1b:
+                self.lastint = self.unsigned_to_signed(self.decode_int(4), 32)
+            case 0x1c:
+                self.lastint = self.unsigned_to_signed(self.decode_int(2), 16)
+            case 0x1d:
+                self.lastint = self.unsigned_to_signed(self.decode_int(1), 8)
+            case 0x1e:
+                self.lastint = self.decode_int(0)
+                self.lastint = self.lastint.Neg(self.lastint)
+            case 0x1f:
+                self.lastint = self.decode_int(0)
+            }
+            self.traced(trace_value, control, 0, self.lastint)
+            return control
+        case 0x20:
+            switch control {
+            case 0x20, 0x2e, 0x2f:
+                self.traced(trace_value, control, 0, nil)
+                return control
+            case 0x2b:
+                self.discard(10)
+                self.traced(trace_value, control, 0, nil)
+                return control
+            case 0x2c:
+                self.discard(8)
+                self.traced(trace_value, control, 0, nil)
+                return control
+            case 0x2d:
+                self.discard(4)
+                self.traced(trace_value, control, 0, nil)
+                return control
+            }
+        case 0x30: {
+            var length uint64
+            switch control {
+            default:
+                length = uint64(control & 0xf)
+            case 0x3c:
+                self.skip_hash_reference(control)
+                return control
+            case 0x3d:
+                length = self.decode_length(2)
+            case 0x3e:
+                length = self.decode_length(1)
+            case 0x3f:
+                length = self.decode_length(0)
+            }
+            self.load_string_utf16le(length)
+            self.traced(trace_value, control, length, nil)
+            return control
+        }
+        case 0x40: {
+            var length uint64
+            switch control {
+            default:
+                length = uint64(control & 0xf)
+            case 0x4d:
+                length = self.decode_length(2)
+            case 0x4e:
+                length = self.decode_length(1)
+            case 0x4f:
+                length = self.decode_length(0)
+            }
+            self.load_string_utf8(length)
+            self.traced(trace_value, control, length, nil)
+            return control
+        }
+        case 0x50: {
+            var length uint64
+            switch control {
+            default:
+                length = uint64(control & 0xf)
+            case 0x5c:
+                self.skip_hash_reference(control)
+                return control
+            case 0x5d:
+                length = self.decode_length(2)
+            case 0x5e:
+                length = self.decode_length(1)
+            case 0x5f:
+                length = self.decode_length(0)
+            }
+            self.skip_bytes(length)
+            self.traced(trace_value, control, length, nil)
+            return control
+        }
+        case 0x70:
+            self.skip_refresher(control)
+            continue
+        case 0x80: {
+            var length uint64
+            switch control {
+            case 0x8d:
+                length = self.decode_length(2)
+            case 0x8e:
+                length = self.decode_length(1)
+            case 0x8f:
+                length = self.decode_length(0)
+            default:
+                length = uint64(control & 0xf)
+            }
+            self.traced(trace_value, control, length, nil)
+            self.skip_values(length)
+            return control
+        }
+        case 0x90, 0xa0: {
+            // Objects hold key-value pairs, swapped arrays hold columns of
+            // names and value arrays
+            var length uint64
+            switch control & 0xf {
+            case 0x0:
+                if control == 0xa0 {
+                    self.traced(trace_value, control, 0, nil)
+                    return control
+                }
+            case 0xd:
+                length = self.decode_length(2)
+            case 0xe:
+                length = self.decode_length(1)
+            case 0xf:
+                length = self.decode_length(0)
+            default:
+                length = uint64(control & 0xf)
+            }
+            self.traced(trace_value, control, length, nil)
+            self.tracedepth++
+            for i := uint64(0); i < length && !self.stopped(); i++ {
+                self.skip_value()
+                self.skip_value()
+            }
+            self.tracedepth--
+            return control
+        }
+        case 0xc0:
+            switch control {
+            case 0xc8:
+                self.traced(trace_value, control, 0, nil)
+                self.tracedepth++
+                for !self.stopped() && self.skip_value() != 0xa0 {
+                }
+                self.tracedepth--
+                return control
+            case 0xca:
+                self.traced(trace_value, control, 0, nil)
+                continue
+            }
+        case 0xd0: {
+            var delta *big.Int
+            switch control {
+            case 0xd0, 0xd1, 0xd2, 0xd3, 0xd4, 0xd5:
+                delta = big.NewInt(int64(control & 0xf))
+            case 0xd6, 0xd7, 0xd8, 0xd9, 0xda:
+                delta = big.NewInt(int64(control & 0xf) - 11)
+            case 0xdb:
+                delta = self.unsigned_to_signed(self.decode_int(4), 32)
+            case 0xdc:
+                delta = self.unsigned_to_signed(self.decode_int(2), 16)
+            case 0xdd:
+                delta = self.unsigned_to_signed(self.decode_int(1), 8)
+            case 0xde:
+                delta = self.decode_int(0)
+                delta.Neg(delta)
+            case 0xdf:
+                delta = self.decode_int(0)
+            }
+            if self.lastint != nil {
+                self.lastint.Add(self.lastint, delta)
+                self.traced(trace_value, control, 0, delta)
+            } else {
+                self.traced(trace_value, control, 0, delta)
+                self.store_err(&SyntaxError{
+                    "jksn: JKSN stream contains an invalid delta encoded integer",
+                    self.valueoffset,
+                    nil,
+                })
+            }
+            return control
+        }
+        case 0xf0:
+            if control <= 0xf5 {
+                self.discard(checksum_length(control))
+                self.traced(trace_value, control, 0, nil)
+                continue
+            } else if control >= 0xf8 && control <= 0xfd {
+                self.traced(trace_value, control, 0, nil)
+                self.tracedepth++
+                result := self.skip_value()
+                self.tracedepth--
+                self.discard(checksum_length(control))
+                self.traced(trace_checksum, control, 0, nil)
+                return result
+            } else if control == 0xff {
+                self.traced(trace_value, control, 0, nil)
+                self.skip_values(1)
+                continue
+            }
+        }
+        self.traced(trace_invalid, control, 0, nil)
+        self.store_fatal(&SyntaxError{
+            fmt.Sprintf("jksn: cannot decode JKSN from byte 0x%02x", control),
+            self.readcount-1,
+            nil,
+        })
+        return control
+    }
+}
+
+// skip_refresher follows a hash table refresher whose control byte was read,
+// clearing the hash tables or reading the strings and blobs it holds.
+func (self *Decoder) skip_refresher(control uint8) {
+    var count uint64
+    switch control {
+    case 0x70:
+        self.texthash, self.blobhash = [256]*string{}, [256][]byte{}
+        self.traced(trace_value, control, 0, nil)
+        return
+    case 0x7d:
+        count = self.decode_length(2)
+    case 0x7e:
+        count = self.decode_length(1)
+    case 0x7f:
+        count = self.decode_length(0)
+    default:
+        count = uint64(control & 0xf)
+    }
+    self.traced(trace_value, control, count, nil)
+    self.skip_values(count)
+}
+
+// skip_values skips the items of a container, one level deeper.
+func (self *Decoder) skip_values(count uint64) {
+    self.tracedepth++
+    for i := uint64(0); i < count && !self.stopped(); i++ {
+        self.skip_value()
+    }
+    self.tracedepth--
+}
+
+// skip_bytes reads a blob into the hash table without copying it.
+func (self *Decoder) skip_bytes(length uint64) {
+    buf, err := self.read_bytes(length)
+    if err == nil {
+        self.blobhash[djb_hash(buf)] = buf
+    }
+}
+
+// skip_hash_reference checks that a string or blob hash reference refers to
+// an existing entry, as load_value would.
+func (self *Decoder) skip_hash_reference(control uint8) {
+    hashvalue, err := self.read_byte()
+    if err != nil {
+        return
+    }
+    self.traced(trace_value, control, 0, nil)
+    if (control == 0x3c && self.texthash[hashvalue] == nil) || (control == 0x5c && self.blobhash[hashvalue] == nil) {
+        self.store_err(&SyntaxError{
+            fmt.Sprintf("jksn: JKSN stream requires a non-existing hash: 0x%02x", hashvalue),
+            self.valueoffset,
+            nil,
+        })
+    }
+}
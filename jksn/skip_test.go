@@ -0,0 +1,126 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+ 
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+ 
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "strings"
+    "testing"
+)
+
+// skip_stream makes documents which refer to the strings and integers of
+// earlier ones, including lengthless arrays from BeginArray and EncodeJSON.
+func skip_stream(t *testing.T) []byte {
+    var stream bytes.Buffer
+    encoder := NewEncoder(&stream)
+    check := func(err error) {
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    check(encoder.Encode(map[string]interface{}{ "name": "alpha", "id": 1000, "tags": []string{ "red", "green" } }))
+    check(encoder.Encode([]interface{}{ "alpha", "green", 990, 1010, 70000, -5, []byte("blob!"), []byte("blob!") }))
+    check(encoder.BeginArray())
+    check(encoder.EncodeElement("alpha"))
+    check(encoder.EncodeElement(map[string]interface{}{ "id": 999, "name": "beta" }))
+    check(encoder.EncodeElement([]int{ 1000, 900, -1000000 }))
+    check(encoder.EndArray())
+    // Large enough to be written as a lengthless array
+    var rows strings.Builder
+    rows.WriteString("[")
+    for i := 0; i < 5000; i++ {
+        fmt.Fprintf(&rows, `{"name": "item%d", "id": %d, "tags": [["red"]]},`, i, 1000 - i)
+    }
+    rows.WriteString(`"alpha"]`)
+    check(encoder.EncodeJSON(json.NewDecoder(strings.NewReader(rows.String()))))
+    check(encoder.Encode(map[string]interface{}{ "name": "alpha", "id": 1001, "blob": []byte("blob!") }))
+    return stream.Bytes()
+}
+
+func TestSkip(t *testing.T) {
+    stream := skip_stream(t)
+    if bytes.Count(stream, []byte("jk!\xc8")) != 2 {
+        t.Fatalf("expected two lengthless arrays in % x", stream[:64])
+    }
+    check_skip(t, stream)
+    // 1000, then deltas of -100, -1000, -1000000 and 0 from the document
+    // before, with the 0xa0 of a lengthless array among them
+    check_skip(t, []byte("jk!\x1c\x03\xe8jk!\xdd\x9cjk!\xc8\xa0jk!\xdc\xfc\x18jk!\xdb\xff\xf0\xbd\xc0jk!\xd0"))
+}
+
+// check_skip checks that the documents after those skipped decode as they do
+// without skipping, for any number skipped.
+func check_skip(t *testing.T, stream []byte) {
+    var documents []*Value
+    decoder := NewDecoder(bytes.NewReader(stream))
+    for {
+        document := new(Value)
+        if err := decoder.Decode(document); err == io.EOF {
+            break
+        } else if err != nil {
+            t.Fatal(err)
+        }
+        documents = append(documents, document)
+    }
+    for skipped := 0; skipped <= len(documents); skipped++ {
+        decoder := NewDecoder(bytes.NewReader(stream))
+        for i := 0; i < skipped; i++ {
+            if err := decoder.Skip(); err != nil {
+                t.Fatalf("skipping document %d: %v", i, err)
+            }
+        }
+        for i := skipped; i < len(documents); i++ {
+            document := new(Value)
+            if err := decoder.Decode(document); err != nil {
+                t.Fatalf("document %d after skipping %d: %v", i, skipped, err)
+            }
+            if !document.Equal(documents[i]) {
+                t.Errorf("document %d after skipping %d: got %v, want %v", i, skipped, document.Interface(), documents[i].Interface())
+            }
+        }
+        if err := decoder.Skip(); err != io.EOF {
+            t.Errorf("Skip at the end of the stream returned %v", err)
+        }
+    }
+}
+
+func TestSkipErrors(t *testing.T) {
+    for _, stream := range []string{
+        // A reference to an empty hash table slot
+        "jk!\x82\x41a\x3c\x42",
+        // A delta integer without a previous integer
+        "jk!\xd1",
+        // A lengthless array without its terminator
+        "jk!\xc8\x11\x12",
+        // Not a control byte
+        "jk!\x82\x11\x04",
+    } {
+        decoder := NewDecoder(strings.NewReader(stream))
+        skip_err := decoder.Skip()
+        var value interface{}
+        decode_err := NewDecoder(strings.NewReader(stream)).Decode(&value)
+        if skip_err == nil || decode_err == nil || skip_err.Error() != decode_err.Error() {
+            t.Errorf("% x: Skip returned %v, Decode returned %v", stream, skip_err, decode_err)
+        }
+    }
+}
@@ -0,0 +1,488 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "math"
+    "math/big"
+    "net"
+    "net/url"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// TimeFormat selects how time.Time values are represented in a JKSN stream.
+type TimeFormat int
+
+const (
+    // RFC 3339 string with nanosecond precision, e.g. "2015-01-02T15:04:05.999999999Z07:00"
+    TimeRFC3339 TimeFormat = iota
+    // Integer seconds since the Unix epoch
+    TimeUnix
+    // Integer nanoseconds since the Unix epoch
+    TimeUnixNano
+)
+
+var time_type = reflect.TypeOf(time.Time{})
+var duration_type = reflect.TypeOf(time.Duration(0))
+var ip_type = reflect.TypeOf(net.IP(nil))
+var url_type = reflect.TypeOf(url.URL{})
+var uuid_type = reflect.TypeOf([16]byte{})
+var big_int_type = reflect.TypeOf(big.Int{})
+var big_float_type = reflect.TypeOf(big.Float{})
+var big_rat_type = reflect.TypeOf(big.Rat{})
+var number_type = reflect.TypeOf(json.Number(""))
+
+var nanoseconds_per_second = big.NewInt(int64(time.Second))
+
+func (self *Encoder) SetTimeFormat(format TimeFormat) {
+    self.timeformat = format
+}
+
+func (self *Decoder) SetTimeFormat(format TimeFormat) {
+    self.timeformat = format
+}
+
+// SetCompactFloats causes the Encoder to write a float64 as float32 whenever
+// the conversion loses no precision.
+func (self *Encoder) SetCompactFloats(on bool) {
+    self.compactfloats = on
+}
+
+// SetIntegralFloats causes the Encoder to write floating point numbers
+// without a fractional part as JKSN integers when that is shorter.
+func (self *Encoder) SetIntegralFloats(on bool) {
+    self.integralfloats = on
+}
+
+// UseNumber causes the Decoder to unmarshal floating point numbers and JSON
+// literal numbers into an interface{} as a json.Number instead of a float64.
+func (self *Decoder) UseNumber() {
+    self.usenumber = true
+}
+
+func is_struct_scalar(obj interface{}) bool {
+    switch obj.(type) {
+    case unspecified, undefined, float80, Value, big.Int, big.Float, big.Rat, time.Time, url.URL:
+        return true
+    default:
+        return false
+    }
+}
+
+func (self *Encoder) dump_std(obj interface{}) (result *jksn_proxy, ok bool) {
+    switch obj.(type) {
+    case time.Time: {
+        obj_time := obj.(time.Time)
+        switch self.timeformat {
+        case TimeUnix:
+            return self.dump_int(big.NewInt(obj_time.Unix())), true
+        case TimeUnixNano: {
+            nanoseconds := new(big.Int).Mul(big.NewInt(obj_time.Unix()), nanoseconds_per_second)
+            nanoseconds.Add(nanoseconds, big.NewInt(int64(obj_time.Nanosecond())))
+            return self.dump_int(nanoseconds), true
+        }
+        default:
+            return self.dump_string(obj_time.Format(time.RFC3339Nano)), true
+        }
+    }
+    case time.Duration:
+        return self.dump_int(big.NewInt(int64(obj.(time.Duration)))), true
+    case net.IP:
+        if obj.(net.IP) == nil {
+            return self.dump_nil(nil), true
+        }
+        return self.dump_string(obj.(net.IP).String()), true
+    case url.URL: {
+        obj_url := obj.(url.URL)
+        return self.dump_string(obj_url.String()), true
+    }
+    case big.Float: {
+        obj_float := obj.(big.Float)
+        if obj_float.IsInf() {
+            if obj_float.Signbit() {
+                return self.dump_float64(math.Inf(-1)), true
+            } else {
+                return self.dump_float64(math.Inf(1)), true
+            }
+        }
+        return self.dump_json_number(big_float_to_text(&obj_float)), true
+    }
+    case big.Rat: {
+        obj_rat := obj.(big.Rat)
+        if obj_rat.IsInt() {
+            return self.dump_int(new(big.Int).Set(obj_rat.Num())), true
+        }
+        return self.dump_string(obj_rat.String()), true
+    }
+    case json.Number: {
+        obj_number := string(obj.(json.Number))
+        if obj_number == "" {
+            obj_number = "0"
+        }
+        if obj_int, ok := new(big.Int).SetString(obj_number, 10); ok {
+            return self.dump_int(obj_int), true
+        }
+        if !is_json_number(obj_number) {
+            self.store_err(&UnsupportedValueError{ reflect.ValueOf(obj), "invalid number literal " + strconv.Quote(obj_number) })
+            return self.dump_nil(nil), true
+        }
+        return self.dump_json_number(obj_number), true
+    }
+    }
+    return nil, false
+}
+
+func (self *Encoder) dump_json_number(obj string) (result *jksn_proxy) {
+    result = new_jksn_proxy(json.Number(obj), 0x0f, empty_bytes, empty_bytes)
+    result.Children = []*jksn_proxy{ self.dump_string(obj) }
+    return
+}
+
+func big_float_to_text(obj *big.Float) string {
+    if obj.Sign() == 0 {
+        if obj.Signbit() {
+            return "-0"
+        }
+        return "0"
+    }
+    if obj.IsInt() {
+        obj_int, _ := obj.Int(nil)
+        return obj_int.String()
+    }
+    // The denominator of a finite binary float is a power of two 2^k,
+    // so exactly k decimal places represent it without loss.
+    obj_rat, _ := obj.Rat(nil)
+    places := obj_rat.Denom().BitLen() - 1
+    return strings.TrimRight(obj_rat.FloatString(places), "0")
+}
+
+func text_to_big_float(text string, prec uint) (*big.Float, error) {
+    if prec != 0 {
+        result, _, err := big.ParseFloat(text, 10, prec, big.ToNearestEven)
+        return result, err
+    }
+    // Each decimal digit needs less than 4 bits, so this is always exact
+    // for the output of big_float_to_text.
+    result, _, err := big.ParseFloat(text, 10, uint(len(text))*4 + 64, big.ToNearestEven)
+    if err != nil {
+        return nil, err
+    }
+    prec = result.MinPrec()
+    if prec < 64 {
+        prec = 64
+    }
+    return result.SetPrec(prec), nil
+}
+
+func float80_to_generic(buf [10]byte) interface{} {
+    negative := buf[0] & 0x80 != 0
+    exponent := int(buf[0] & 0x7f) << 8 | int(buf[1])
+    mantissa := binary.BigEndian.Uint64(buf[2:])
+    if exponent == 0x7fff {
+        if mantissa << 1 != 0 {
+            return math.NaN()
+        } else if negative {
+            return math.Inf(-1)
+        } else {
+            return math.Inf(1)
+        }
+    }
+    // x87 extended precision keeps the integer bit explicitly, so the value
+    // is mantissa * 2^(exponent-16383-63), with denormals using exponent 1.
+    if exponent == 0 {
+        exponent = 1
+    }
+    result := new(big.Float).SetPrec(64).SetUint64(mantissa)
+    result.SetMantExp(result, exponent - 16383 - 63)
+    if negative {
+        result.Neg(result)
+    }
+    return result
+}
+
+func is_json_number(text string) bool {
+    if len(text) == 0 || (text[0] != '-' && (text[0] < '0' || text[0] > '9')) {
+        return false
+    }
+    return json.Valid([]byte(text))
+}
+
+func json_number_to_generic(obj json.Number) interface{} {
+    if result, ok := new(big.Int).SetString(string(obj), 10); ok {
+        return result
+    }
+    result, _ := strconv.ParseFloat(string(obj), 64)
+    return result
+}
+
+func (self *Decoder) load_json_literal(literal string) interface{} {
+    json_decoder := json.NewDecoder(bytes.NewReader([]byte(literal)))
+    json_decoder.UseNumber()
+    var result interface{}
+    if err := json_decoder.Decode(&result); err != nil {
+        self.store_err(&SyntaxError{ "jksn: invalid JSON literal: " + err.Error(), self.valueoffset, err })
+        return nil
+    }
+    return from_json_value(result)
+}
+
+func from_json_value(obj interface{}) interface{} {
+    switch obj.(type) {
+    case []interface{}: {
+        obj_array := obj.([]interface{})
+        for i, item := range obj_array {
+            obj_array[i] = from_json_value(item)
+        }
+        return obj_array
+    }
+    case map[string]interface{}: {
+        obj_map := obj.(map[string]interface{})
+        result := make(map[interface{}]interface{}, len(obj_map))
+        for key, value := range obj_map {
+            result[key] = from_json_value(value)
+        }
+        return result
+    }
+    default:
+        return obj
+    }
+}
+
+func (self *Decoder) export_value(obj interface{}) interface{} {
+    switch obj.(type) {
+    case undefined:
+        return nil
+    case json.Number:
+        if !self.usenumber {
+            result, _ := strconv.ParseFloat(string(obj.(json.Number)), 64)
+            return result
+        }
+    case float64:
+        if self.usenumber && !math.IsNaN(obj.(float64)) && !math.IsInf(obj.(float64), 0) {
+            return json.Number(strconv.FormatFloat(obj.(float64), 'g', -1, 64))
+        }
+    case float32:
+        if self.usenumber && !math.IsNaN(float64(obj.(float32))) && !math.IsInf(float64(obj.(float32)), 0) {
+            return json.Number(strconv.FormatFloat(float64(obj.(float32)), 'g', -1, 32))
+        }
+    case []interface{}: {
+        obj_array := obj.([]interface{})
+        for i, item := range obj_array {
+            obj_array[i] = self.export_value(item)
+        }
+    }
+    case map[interface{}]interface{}: {
+        obj_map := obj.(map[interface{}]interface{})
+        for key, value := range obj_map {
+            obj_map[key] = self.export_value(value)
+        }
+    }
+    case []map[interface{}]interface{}: {
+        for _, row := range obj.([]map[interface{}]interface{}) {
+            for key, value := range row {
+                row[key] = self.export_value(value)
+            }
+        }
+    }
+    }
+    return obj
+}
+
+func (self *Decoder) fit_std(value reflect.Value, generic_value interface{}) bool {
+    switch value.Type().Elem() {
+    case time_type:
+        switch generic_value.(type) {
+        case string: {
+            result, err := time.Parse(time.RFC3339Nano, generic_value.(string))
+            if err != nil {
+                self.store_err(self.type_error_cause(generic_value, value.Type(), err))
+            } else {
+                value.Elem().Set(reflect.ValueOf(result))
+            }
+        }
+        case *big.Int: {
+            seconds, nanoseconds := new(big.Int), new(big.Int)
+            if self.timeformat == TimeUnixNano {
+                seconds.DivMod(generic_value.(*big.Int), nanoseconds_per_second, nanoseconds)
+            } else {
+                seconds.Set(generic_value.(*big.Int))
+            }
+            value.Elem().Set(reflect.ValueOf(time.Unix(seconds.Int64(), nanoseconds.Int64()).UTC()))
+        }
+        case float32, float64: {
+            seconds := reflect.ValueOf(generic_value).Float()
+            integral, fractional := math.Modf(seconds)
+            value.Elem().Set(reflect.ValueOf(time.Unix(int64(integral), int64(fractional*1e9)).UTC()))
+        }
+        default:
+            self.store_err(self.type_error(generic_value, value.Type()))
+        }
+        return true
+    case duration_type:
+        if s, ok := generic_value.(string); ok {
+            result, err := time.ParseDuration(s)
+            if err != nil {
+                self.store_err(self.type_error_cause(generic_value, value.Type(), err))
+            } else {
+                value.Elem().SetInt(int64(result))
+            }
+            return true
+        }
+    case ip_type:
+        switch generic_value.(type) {
+        case string: {
+            result := net.ParseIP(generic_value.(string))
+            if result == nil {
+                self.store_err(self.type_error(generic_value, value.Type()))
+            } else {
+                value.Elem().Set(reflect.ValueOf(result))
+            }
+            return true
+        }
+        case []byte: {
+            generic_bytes := generic_value.([]byte)
+            if len(generic_bytes) != net.IPv4len && len(generic_bytes) != net.IPv6len {
+                self.store_err(self.type_error(generic_value, value.Type()))
+            } else {
+                result := make(net.IP, len(generic_bytes))
+                copy(result, generic_bytes)
+                value.Elem().Set(reflect.ValueOf(result))
+            }
+            return true
+        }
+        }
+    case url_type:
+        if s, ok := generic_value.(string); ok {
+            result, err := url.Parse(s)
+            if err != nil {
+                self.store_err(self.type_error_cause(generic_value, value.Type(), err))
+            } else {
+                value.Elem().Set(reflect.ValueOf(*result))
+            }
+            return true
+        }
+    case big_int_type: {
+        result := reflect.New(reflect.PointerTo(big_int_type))
+        self.fit_type(result, generic_value)
+        if !result.Elem().IsNil() {
+            value.Elem().Set(result.Elem().Elem())
+        }
+        return true
+    }
+    case big_float_type: {
+        target := value.Interface().(*big.Float)
+        switch generic_value.(type) {
+        case json.Number, string: {
+            result, err := text_to_big_float(reflect.ValueOf(generic_value).String(), target.Prec())
+            if err != nil {
+                self.store_err(self.type_error(generic_value, value.Type()))
+            } else {
+                target.Set(result)
+            }
+        }
+        case *big.Int:
+            target.SetInt(generic_value.(*big.Int))
+        case *big.Float:
+            target.Set(generic_value.(*big.Float))
+        case float32, float64: {
+            generic_float := reflect.ValueOf(generic_value).Float()
+            if math.IsNaN(generic_float) {
+                self.store_err(self.type_error(generic_value, value.Type()))
+            } else {
+                target.SetFloat64(generic_float)
+            }
+        }
+        default:
+            self.store_err(self.type_error(generic_value, value.Type()))
+        }
+        return true
+    }
+    case big_rat_type: {
+        target := value.Interface().(*big.Rat)
+        switch generic_value.(type) {
+        case json.Number, string:
+            if _, ok := target.SetString(reflect.ValueOf(generic_value).String()); !ok {
+                self.store_err(self.type_error(generic_value, value.Type()))
+            }
+        case *big.Int:
+            target.SetInt(generic_value.(*big.Int))
+        case *big.Float:
+            generic_value.(*big.Float).Rat(target)
+        case float32, float64: {
+            generic_float := reflect.ValueOf(generic_value).Float()
+            if math.IsNaN(generic_float) || math.IsInf(generic_float, 0) {
+                self.store_err(self.type_error(generic_value, value.Type()))
+            } else {
+                target.SetFloat64(generic_float)
+            }
+        }
+        default:
+            self.store_err(self.type_error(generic_value, value.Type()))
+        }
+        return true
+    }
+    case number_type:
+        switch generic_value.(type) {
+        case json.Number:
+            value.Elem().SetString(string(generic_value.(json.Number)))
+        case *big.Int:
+            value.Elem().SetString(generic_value.(*big.Int).String())
+        case *big.Float:
+            value.Elem().SetString(big_float_to_text(generic_value.(*big.Float)))
+        case float32, float64: {
+            generic_float := reflect.ValueOf(generic_value).Float()
+            if math.IsNaN(generic_float) || math.IsInf(generic_float, 0) {
+                self.store_err(self.type_error(generic_value, value.Type()))
+            } else if _, ok := generic_value.(float32); ok {
+                value.Elem().SetString(strconv.FormatFloat(generic_float, 'g', -1, 32))
+            } else {
+                value.Elem().SetString(strconv.FormatFloat(generic_float, 'g', -1, 64))
+            }
+        }
+        case string:
+            if is_json_number(generic_value.(string)) {
+                value.Elem().SetString(generic_value.(string))
+            } else {
+                self.store_err(self.type_error(generic_value, value.Type()))
+            }
+        default:
+            self.store_err(self.type_error(generic_value, value.Type()))
+        }
+        return true
+    case uuid_type:
+        if s, ok := generic_value.(string); ok && len(s) == 36 {
+            result, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+            if err != nil || len(result) != 16 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+                self.store_err(self.type_error(generic_value, value.Type()))
+            } else {
+                reflect.Copy(value.Elem().Slice(0, 16), reflect.ValueOf(result))
+            }
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,469 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math"
+    "math/big"
+    "reflect"
+    "sort"
+    "strconv"
+)
+
+// transcode_buffer_limit is how many bytes of an array are held back before
+// it is written as a lengthless array instead of one with a length.
+const transcode_buffer_limit = 64 << 10
+
+// TranscodeFromJSON converts every JSON value read from reader into a JKSN
+// document, without building Go values for them. See Encoder.EncodeJSON.
+func TranscodeFromJSON(writer io.Writer, reader io.Reader) error {
+    buffered := bufio.NewWriter(writer)
+    encoder := NewEncoder(buffered)
+    json_decoder := json.NewDecoder(reader)
+    for {
+        if err := encoder.EncodeJSON(json_decoder); err == io.EOF {
+            break
+        } else if err != nil {
+            buffered.Flush()
+            return err
+        }
+    }
+    return buffered.Flush()
+}
+
+// EncodeJSON reads the next JSON value from json_decoder, token by token,
+// and writes it as a JKSN document. It returns io.EOF if there is none left,
+// and sets json_decoder to UseNumber.
+//
+// Integers keep every digit and objects keep the order of their keys. Arrays
+// which are not inside an object are written as they are read once they grow
+// large. JKSN objects have no lengthless form, so an object is held in memory
+// with everything inside it until its keys are counted: memory use is
+// bounded by the largest object which is not inside another, such as the
+// whole of {"data": [...]}. SetMaxBuffer turns such an object into an error
+// once it grows past a limit. Unlike Encode, arrays of objects are never
+// row-col swapped, and as output starts before the value is read whole,
+// invalid JSON or an object over the limit leaves a partial document behind.
+func (self *Encoder) EncodeJSON(json_decoder *json.Decoder) error {
+    return self.transcode_value(json_decoder, []byte("jk!"))
+}
+
+// EncodeJSONElement is like EncodeJSON, but writes an element of an array
+// started with BeginArray.
+func (self *Encoder) EncodeJSONElement(json_decoder *json.Decoder) error {
+    return self.transcode_value(json_decoder, nil)
+}
+
+// transcode_frame is an array or object being transcoded. Its items are
+// held in buf until it ends, unless it is an array streaming its items as a
+// lengthless array.
+type transcode_frame struct {
+    object      bool
+    count       int
+    buf         bytes.Buffer
+    // How much of buf is counted in json_transcoder.buffered
+    counted     int
+    streaming   bool
+    // Where the array or object starts in the JSON input
+    offset      int64
+}
+
+type json_transcoder struct {
+    encoder     *Encoder
+    frames      []*transcode_frame
+    // Bytes held in the buffers of all frames
+    buffered    int
+    err         error
+}
+
+func (self *Encoder) transcode_value(json_decoder *json.Decoder, prefix []byte) error {
+    json_decoder.UseNumber()
+    token, err := json_decoder.Token()
+    if err != nil {
+        return err
+    }
+    self.firsterr = nil
+    transcoder := &json_transcoder{ encoder: self }
+    transcoder.write(prefix)
+    for {
+        switch token.(type) {
+        case json.Delim:
+            switch token.(json.Delim) {
+            case '[', '{':
+                transcoder.frames = append(transcoder.frames, &transcode_frame{ object: token.(json.Delim) == '{', offset: json_decoder.InputOffset()-1 })
+            default:
+                transcoder.close()
+            }
+        case json.Number:
+            transcoder.scalar(self.dump_json_token(string(token.(json.Number))))
+        default:
+            transcoder.scalar(self.dump_value(token))
+        }
+        if transcoder.err != nil {
+            return transcoder.err
+        }
+        if len(transcoder.frames) == 0 {
+            return self.firsterr
+        }
+        if token, err = json_decoder.Token(); err != nil {
+            if err == io.EOF {
+                err = io.ErrUnexpectedEOF
+            }
+            return err
+        }
+    }
+}
+
+// dump_json_token writes a JSON number as an integer if it is one, or else
+// as a float64. Numbers beyond the range of a float64 are kept as literals.
+func (self *Encoder) dump_json_token(number string) *jksn_proxy {
+    if number_int, ok := new(big.Int).SetString(number, 10); ok {
+        return self.dump_int(number_int)
+    }
+    number_float, err := strconv.ParseFloat(number, 64)
+    if err != nil {
+        return self.dump_json_number(number)
+    }
+    return self.dump_float64(number_float)
+}
+
+// sink is where the items of the innermost frame go.
+func (self *json_transcoder) sink() io.Writer {
+    if len(self.frames) != 0 && !self.frames[len(self.frames)-1].streaming {
+        return &self.frames[len(self.frames)-1].buf
+    }
+    return self
+}
+
+func (self *json_transcoder) Write(data []byte) (int, error) {
+    if self.err != nil {
+        return 0, self.err
+    }
+    var n int
+    n, self.err = self.encoder.writer.Write(data)
+    return n, self.err
+}
+
+func (self *json_transcoder) write(data []byte) {
+    self.Write(data)
+}
+
+func (self *json_transcoder) scalar(value *jksn_proxy) {
+    self.encoder.optimize(value).Output(self.sink(), true)
+    self.item_done()
+}
+
+// close ends the innermost frame and writes it to the frame around it.
+func (self *json_transcoder) close() {
+    frame := self.frames[len(self.frames)-1]
+    self.frames = self.frames[:len(self.frames)-1]
+    self.buffered -= frame.counted
+    switch {
+    case frame.streaming:
+        self.write([]byte{ 0xa0 })
+    case frame.object:
+        sink := self.sink()
+        sink.Write(self.encoder.container_header(0x90, frame.count / 2))
+        sink.Write(frame.buf.Bytes())
+    default:
+        sink := self.sink()
+        sink.Write(self.encoder.container_header(0x80, frame.count))
+        sink.Write(frame.buf.Bytes())
+    }
+    self.item_done()
+}
+
+// item_done counts an item of the innermost frame. An array which is not
+// inside an object starts streaming once it has buffered enough, and so do
+// the arrays around it. Inside an object it keeps buffering, as the object
+// is written only when it ends, unless that takes more memory than
+// SetMaxBuffer allows.
+func (self *json_transcoder) item_done() {
+    if len(self.frames) == 0 {
+        return
+    }
+    frame := self.frames[len(self.frames)-1]
+    frame.count++
+    self.buffered += frame.buf.Len() - frame.counted
+    frame.counted = frame.buf.Len()
+    if !frame.object && !frame.streaming && frame.buf.Len() >= transcode_buffer_limit {
+        self.start_streaming()
+    }
+    if limit := self.encoder.maxbuffer; limit != 0 && self.buffered > limit && self.err == nil {
+        self.err = self.over_limit()
+    }
+}
+
+// start_streaming turns the innermost array and the arrays around it which
+// still buffer into lengthless arrays, unless one of them is inside an
+// object.
+func (self *json_transcoder) start_streaming() {
+    first := len(self.frames)
+    for first != 0 && !self.frames[first-1].streaming {
+        if self.frames[first-1].object {
+            return
+        }
+        first--
+    }
+    for _, frame := range self.frames[first:] {
+        self.write([]byte{ 0xc8 })
+        self.write(frame.buf.Bytes())
+        self.buffered -= frame.counted
+        frame.buf, frame.counted = bytes.Buffer{}, 0
+        frame.streaming = true
+    }
+}
+
+// over_limit reports the outermost object, which has to be buffered whole,
+// or else the outermost array still buffering, if the limit is that small.
+func (self *json_transcoder) over_limit() error {
+    var frame *transcode_frame
+    for _, frame = range self.frames {
+        if frame.object {
+            break
+        }
+    }
+    if !frame.object {
+        for _, frame = range self.frames {
+            if !frame.streaming {
+                break
+            }
+        }
+    }
+    kind := "array"
+    if frame.object {
+        kind = "object"
+    }
+    return fmt.Errorf("jksn: JSON %s at input offset %d needs more than %d bytes of memory, as JKSN writes its length before its items", kind, frame.offset, self.encoder.maxbuffer)
+}
+
+// container_header returns the header of a straight array (base 0x80) or an
+// object (base 0x90) of length items.
+func (self *Encoder) container_header(base uint8, length int) []byte {
+    if length <= 0xc {
+        return []byte{ base | uint8(length) }
+    } else if length <= 0xff {
+        return append([]byte{ base | 0xe }, self.encode_int(big.NewInt(int64(length)), 1)...)
+    } else if length <= 0xffff {
+        return append([]byte{ base | 0xd }, self.encode_int(big.NewInt(int64(length)), 2)...)
+    } else {
+        return append([]byte{ base | 0xf }, self.encode_int(big.NewInt(int64(length)), 0)...)
+    }
+}
+
+// TranscodeToJSON converts every JKSN document read from reader into a line
+// of compact JSON, without building Go values for them. Arrays and objects
+// are written as they are read, keeping the order of keys, so memory use
+// does not grow with the document, except for row-col swapped arrays, which
+// are read whole.
+//
+// Integers keep every digit, blobs become base64 strings, undefined and
+// unspecified values become null, and keys which are not strings become
+// their JSON text as a string. NaN and infinities have no JSON form and are
+// an error.
+func TranscodeToJSON(writer io.Writer, reader io.Reader) error {
+    buffered := bufio.NewWriter(writer)
+    decoder := NewDecoder(reader)
+    for {
+        if err := decoder.begin_document(); err == io.EOF {
+            break
+        } else if err != nil {
+            buffered.Flush()
+            return err
+        }
+        _, err := decoder.transcode_value(buffered, false, 0)
+        if err == nil {
+            err = buffered.WriteByte('\n')
+        }
+        if err != nil {
+            buffered.Flush()
+            return err
+        }
+    }
+    return buffered.Flush()
+}
+
+// transcode_value writes the next value as JSON, after separator unless it
+// is 0. Inside a lengthless array, end reports that the terminator was read
+// instead.
+func (self *Decoder) transcode_value(writer *bufio.Writer, lengthless bool, separator byte) (end bool, err error) {
+    control, ok := self.peek_control()
+    if !ok || !is_container(control) {
+        value := self.load_value()
+        // Only type errors look at the marks of the items read
+        self.marks = self.marks[:0]
+        if self.stopped() {
+            return false, self.transcode_err()
+        }
+        if _, ok := value.(unspecified); ok && lengthless {
+            return true, nil
+        }
+        if separator != 0 {
+            writer.WriteByte(separator)
+        }
+        return false, write_json_value(writer, value)
+    }
+    if separator != 0 {
+        writer.WriteByte(separator)
+    }
+    length := self.open_container(control)
+    object := control & 0xf0 == 0x90
+    if object {
+        writer.WriteByte('{')
+    } else {
+        writer.WriteByte('[')
+    }
+    for i := uint64(0); control == 0xc8 || i < length; i++ {
+        separator = 0
+        if i != 0 {
+            separator = ','
+        }
+        if object {
+            key := self.load_value()
+            if self.stopped() {
+                return false, self.transcode_err()
+            }
+            if separator != 0 {
+                writer.WriteByte(separator)
+            }
+            if err := write_json_key(writer, key); err != nil {
+                return false, err
+            }
+            separator = ':'
+        }
+        if end, err := self.transcode_value(writer, control == 0xc8, separator); err != nil {
+            return false, err
+        } else if end {
+            break
+        }
+    }
+    if object {
+        return false, writer.WriteByte('}')
+    }
+    return false, writer.WriteByte(']')
+}
+
+// transcode_err returns the error which stopped the decoder, or reports
+// that the stream ended inside a value.
+func (self *Decoder) transcode_err() error {
+    if err := self.result_err(); err != nil {
+        return err
+    }
+    return &SyntaxError{ "jksn: unexpected end of stream", self.readcount, io.ErrUnexpectedEOF }
+}
+
+func write_json_key(writer *bufio.Writer, key interface{}) error {
+    if key_string, ok := key.(string); ok {
+        return write_json_value(writer, key_string)
+    }
+    var buf bytes.Buffer
+    key_writer := bufio.NewWriter(&buf)
+    if err := write_json_value(key_writer, key); err != nil {
+        return err
+    }
+    key_writer.Flush()
+    return write_json_value(writer, buf.String())
+}
+
+// write_json_value writes a value returned by load_value.
+func write_json_value(writer *bufio.Writer, value interface{}) error {
+    switch value.(type) {
+    case nil, undefined, unspecified:
+        _, err := writer.WriteString("null")
+        return err
+    case *big.Int:
+        _, err := writer.WriteString(value.(*big.Int).String())
+        return err
+    case float64, float32: {
+        number := reflect.ValueOf(value).Float()
+        if math.IsNaN(number) || math.IsInf(number, 0) {
+            return &UnsupportedValueError{ reflect.ValueOf(value), "cannot write " + strconv.FormatFloat(number, 'g', -1, 64) + " as JSON" }
+        }
+    }
+    case *big.Float: {
+        number := value.(*big.Float)
+        if number.IsInf() {
+            return &UnsupportedValueError{ reflect.ValueOf(value), "cannot write " + number.String() + " as JSON" }
+        }
+        _, err := writer.WriteString(number.Text('g', -1))
+        return err
+    }
+    case []interface{}: {
+        writer.WriteByte('[')
+        for i, item := range value.([]interface{}) {
+            if i != 0 {
+                writer.WriteByte(',')
+            }
+            if err := write_json_value(writer, item); err != nil {
+                return err
+            }
+        }
+        return writer.WriteByte(']')
+    }
+    case []map[interface{}]interface{}: {
+        writer.WriteByte('[')
+        for i, item := range value.([]map[interface{}]interface{}) {
+            if i != 0 {
+                writer.WriteByte(',')
+            }
+            if err := write_json_value(writer, item); err != nil {
+                return err
+            }
+        }
+        return writer.WriteByte(']')
+    }
+    case map[interface{}]interface{}: {
+        // Maps have no order of their own, so their keys are sorted
+        obj := value.(map[interface{}]interface{})
+        keys := make([]interface{}, 0, len(obj))
+        for key := range obj {
+            keys = append(keys, key)
+        }
+        sort.Slice(keys, func(i, j int) bool {
+            return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+        })
+        writer.WriteByte('{')
+        for i, key := range keys {
+            if i != 0 {
+                writer.WriteByte(',')
+            }
+            if err := write_json_key(writer, key); err != nil {
+                return err
+            }
+            writer.WriteByte(':')
+            if err := write_json_value(writer, obj[key]); err != nil {
+                return err
+            }
+        }
+        return writer.WriteByte('}')
+    }
+    }
+    data, err := json.Marshal(value)
+    if err != nil {
+        return err
+    }
+    _, err = writer.Write(data)
+    return err
+}
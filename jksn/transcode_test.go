@@ -0,0 +1,248 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+ 
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+ 
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "runtime"
+    "strings"
+    "testing"
+)
+
+// transcode_json is a stream of JSON documents which TranscodeToJSON writes
+// back as they are, keeping the order of keys.
+const transcode_json = `{"name":"ann","id":1000,"tags":["x","y","x"],"z":{},"a":[]}
+[1001,1003,-1,123456789012345678901234567890,-98765432109876543210]
+[0.5,-2.25,1e+22,"été 😀",true,false,null]
+{"rows":[{"k":"v","n":1},{"k":"w","n":2}],"ann":"ann","":{"nested":[[[]]]}}
+"ann"
+7
+`
+
+func TestTranscodeRoundTrip(t *testing.T) {
+    var stream, text bytes.Buffer
+    if err := TranscodeFromJSON(&stream, strings.NewReader(transcode_json)); err != nil {
+        t.Fatal(err)
+    }
+    jksn_stream := bytes.Clone(stream.Bytes())
+    if err := TranscodeToJSON(&text, &stream); err != nil {
+        t.Fatal(err)
+    }
+    if text.String() != transcode_json {
+        t.Fatalf("got\n%s\nwant\n%s", text.String(), transcode_json)
+    }
+
+    // Transcoding agrees with decoding into Go values and encoding them
+    decoder := NewDecoder(bytes.NewReader(jksn_stream))
+    json_decoder := json.NewDecoder(strings.NewReader(transcode_json))
+    json_decoder.UseNumber()
+    for {
+        var want interface{}
+        if err := json_decoder.Decode(&want); err == io.EOF {
+            break
+        } else if err != nil {
+            t.Fatal(err)
+        }
+        got := new(Value)
+        if err := decoder.Decode(got); err != nil {
+            t.Fatal(err)
+        }
+        want_value, err := ValueOf(want)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !got.Equal(want_value) {
+            t.Errorf("decoded %v, want %v", got.Interface(), want)
+        }
+    }
+
+    // From JKSN written by Encode, including a swapped array, and back
+    var encoded, round_trip bytes.Buffer
+    encoder := NewEncoder(&encoded)
+    var values []*Value
+    json_decoder = json.NewDecoder(strings.NewReader(transcode_json))
+    json_decoder.UseNumber()
+    for {
+        var value interface{}
+        if err := json_decoder.Decode(&value); err == io.EOF {
+            break
+        } else if err != nil {
+            t.Fatal(err)
+        }
+        if err := encoder.Encode(value); err != nil {
+            t.Fatal(err)
+        }
+        item, _ := ValueOf(value)
+        values = append(values, item)
+    }
+    text.Reset()
+    if err := TranscodeToJSON(&text, &encoded); err != nil {
+        t.Fatal(err)
+    }
+    if err := TranscodeFromJSON(&round_trip, &text); err != nil {
+        t.Fatal(err)
+    }
+    decoder = NewDecoder(&round_trip)
+    for _, want := range values {
+        got := new(Value)
+        if err := decoder.Decode(got); err != nil {
+            t.Fatal(err)
+        }
+        if !got.Equal(want) {
+            t.Errorf("got %v, want %v", got.Interface(), want.Interface())
+        }
+    }
+}
+
+// json_rows is a reader of a JSON array of count objects, made as it is
+// read.
+type json_rows struct {
+    count   int
+    next    int
+    buf     bytes.Buffer
+}
+
+func (self *json_rows) Read(data []byte) (int, error) {
+    for self.buf.Len() < len(data) && self.next <= self.count {
+        switch {
+        case self.next == self.count:
+            self.buf.WriteString("]")
+        case self.next == 0:
+            self.buf.WriteString("[")
+        default:
+            self.buf.WriteString(",")
+        }
+        if self.next < self.count {
+            fmt.Fprintf(&self.buf, `{"id":%d,"name":"row %d","tags":["a","b"]}`, self.next, self.next)
+        }
+        self.next++
+    }
+    if self.buf.Len() == 0 {
+        return 0, io.EOF
+    }
+    return self.buf.Read(data)
+}
+
+// heap_watcher discards what is written to it, keeping the first and last
+// bytes, and samples the size of the heap as it goes.
+type heap_watcher struct {
+    head, tail  []byte
+    written     int
+    peak        uint64
+}
+
+func (self *heap_watcher) Write(data []byte) (int, error) {
+    if len(self.head) < 4 {
+        self.head = append(self.head, data[:min(len(data), 4-len(self.head))]...)
+    }
+    self.tail = append(self.tail[:0], data[max(0, len(data)-1):]...)
+    if self.written / (1 << 20) != (self.written + len(data)) / (1 << 20) {
+        var stats runtime.MemStats
+        runtime.ReadMemStats(&stats)
+        self.peak = max(self.peak, stats.HeapAlloc)
+    }
+    self.written += len(data)
+    return len(data), nil
+}
+
+func TestTranscodeLargeArray(t *testing.T) {
+    // Small enough to be buffered, and written with a length
+    var small bytes.Buffer
+    if err := TranscodeFromJSON(&small, &json_rows{ count: 100 }); err != nil {
+        t.Fatal(err)
+    }
+    if small.Bytes()[3] != 0x8e {
+        t.Fatalf("array of 100 items begins with % x", small.Bytes()[:8])
+    }
+
+    // Large enough to stream, and written as a lengthless array
+    var medium bytes.Buffer
+    if err := TranscodeFromJSON(&medium, &json_rows{ count: 20000 }); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.HasPrefix(medium.Bytes(), []byte("jk!\xc8")) || medium.Bytes()[medium.Len()-1] != 0xa0 {
+        t.Fatalf("streamed array is % x .. % x", medium.Bytes()[:8], medium.Bytes()[medium.Len()-4:])
+    }
+    var rows []map[string]interface{}
+    if err := Unmarshal(medium.Bytes(), &rows); err != nil {
+        t.Fatal(err)
+    }
+    if len(rows) != 20000 || rows[12345]["name"] != "row 12345" {
+        t.Fatalf("got %d rows, row 12345 is %v", len(rows), rows[12345])
+    }
+
+    // Memory use does not grow with the array
+    runtime.GC()
+    var stats runtime.MemStats
+    runtime.ReadMemStats(&stats)
+    watcher := &heap_watcher{ peak: stats.HeapAlloc }
+    input := &json_rows{ count: 500000 }
+    if err := TranscodeFromJSON(watcher, input); err != nil {
+        t.Fatal(err)
+    }
+    if string(watcher.head) != "jk!\xc8" || !bytes.Equal(watcher.tail, []byte{ 0xa0 }) {
+        t.Fatalf("large array is % x .. % x", watcher.head, watcher.tail)
+    }
+    if growth := watcher.peak - stats.HeapAlloc; growth > 8 << 20 {
+        t.Errorf("heap grew by %d bytes transcoding %d bytes of JKSN", growth, watcher.written)
+    }
+}
+
+func TestTranscodeMaxBuffer(t *testing.T) {
+    large := new(bytes.Buffer)
+    io.Copy(large, &json_rows{ count: 20000 })
+    for _, test := range []struct {
+        json    string
+        err     string
+    }{
+        // Arrays stream, but an object and the arrays inside it are buffered
+        { large.String(), "" },
+        { `[[1, 2], ` + large.String() + `]`, "" },
+        { `{"data": ` + large.String() + `}`, "JSON object at input offset 0 " },
+        { `[1, {"x": [{"data": ` + large.String() + `}]}]`, "JSON object at input offset 4 " },
+    } {
+        var stream bytes.Buffer
+        encoder := NewEncoder(&stream)
+        encoder.SetMaxBuffer(256 << 10)
+        err := encoder.EncodeJSON(json.NewDecoder(strings.NewReader(test.json)))
+        if test.err != "" {
+            if err == nil || !strings.Contains(err.Error(), test.err) {
+                t.Errorf("%.20s...: got error %v, want %q", test.json, err, test.err)
+            }
+            continue
+        } else if err != nil {
+            t.Errorf("%.20s...: %v", test.json, err)
+            continue
+        }
+        var got, want interface{}
+        if err := Unmarshal(stream.Bytes(), &got); err != nil {
+            t.Fatal(err)
+        }
+        json.Unmarshal([]byte(test.json), &want)
+        got_text, _ := json.Marshal(got)
+        want_text, _ := json.Marshal(want)
+        if !bytes.Equal(got_text, want_text) {
+            t.Errorf("%.20s...: decoded %.40s...", test.json, got_text)
+        }
+    }
+}
@@ -0,0 +1,631 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "math/big"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Kind is the kind of a JKSN value held by a Value.
+type Kind int
+
+const (
+    KindUndefined Kind = iota
+    KindNull
+    KindBool
+    KindInt
+    KindFloat
+    KindString
+    KindBlob
+    KindArray
+    KindObject
+    KindUnspecified
+)
+
+var kind_names = [...]string{ "undefined", "null", "boolean", "integer", "float", "string", "blob", "array", "object", "unspecified" }
+
+func (self Kind) String() string {
+    if self >= 0 && int(self) < len(kind_names) {
+        return kind_names[self]
+    }
+    return "Kind(" + strconv.Itoa(int(self)) + ")"
+}
+
+// Value is a decoded JKSN value of any kind, forming a mutable tree.
+//
+// Accessors never panic: asking for the wrong kind returns the zero value,
+// and Index or Get on a missing element returns nil, whose Kind is
+// KindUndefined, so lookups can be chained.
+//
+// Integer object keys are stored as int64 when they fit, otherwise as
+// *big.Int; Get and Set normalize the keys they are given the same way.
+type Value struct {
+    kind    Kind
+    scalar  interface{}
+    items   []*Value
+    fields  map[interface{}]*Value
+}
+
+// undefined is how a Value of KindUndefined is passed to dump_value.
+type undefined struct {}
+
+var undefined_value = undefined{}
+
+// float80 is how an 80-bit float of a Value is passed to dump_value.
+type float80 struct {
+    value   *big.Float
+}
+
+var value_type = reflect.TypeOf(Value{})
+
+func NewUndefined() *Value {
+    return &Value{ kind: KindUndefined }
+}
+
+func NewNull() *Value {
+    return &Value{ kind: KindNull }
+}
+
+func NewUnspecified() *Value {
+    return &Value{ kind: KindUnspecified }
+}
+
+func NewBool(b bool) *Value {
+    return &Value{ kind: KindBool, scalar: b }
+}
+
+func NewInt(i int64) *Value {
+    return &Value{ kind: KindInt, scalar: big.NewInt(i) }
+}
+
+func NewBigInt(i *big.Int) *Value {
+    return &Value{ kind: KindInt, scalar: new(big.Int).Set(i) }
+}
+
+func NewFloat(f float64) *Value {
+    return &Value{ kind: KindFloat, scalar: f }
+}
+
+func NewString(s string) *Value {
+    return &Value{ kind: KindString, scalar: s }
+}
+
+func NewBlob(b []byte) *Value {
+    return &Value{ kind: KindBlob, scalar: b }
+}
+
+func NewArray(items ...*Value) *Value {
+    return &Value{ kind: KindArray, items: append([]*Value{}, items...) }
+}
+
+func NewObject() *Value {
+    return &Value{ kind: KindObject, fields: make(map[interface{}]*Value) }
+}
+
+// ValueOf converts any value which Encoder accepts into a Value tree.
+func ValueOf(obj interface{}) (*Value, error) {
+    data, err := Marshal(obj)
+    if err != nil {
+        return nil, err
+    }
+    result := new(Value)
+    err = Unmarshal(data, result)
+    return result, err
+}
+
+func (self *Value) Kind() Kind {
+    if self == nil {
+        return KindUndefined
+    }
+    return self.kind
+}
+
+func (self *Value) IsNull() bool {
+    return self.Kind() == KindNull
+}
+
+func (self *Value) Bool() bool {
+    if self == nil {
+        return false
+    }
+    result, _ := self.scalar.(bool)
+    return result
+}
+
+// BigInt returns the value of an integer, or nil for other kinds.
+func (self *Value) BigInt() *big.Int {
+    if self == nil || self.kind != KindInt {
+        return nil
+    }
+    return self.scalar.(*big.Int)
+}
+
+// Int returns the value of an integer, or of a float truncated toward zero.
+// Integers out of the int64 range are clamped.
+func (self *Value) Int() int64 {
+    switch self.Kind() {
+    case KindInt: {
+        result := self.scalar.(*big.Int)
+        if result.IsInt64() {
+            return result.Int64()
+        } else if result.Sign() < 0 {
+            return math.MinInt64
+        } else {
+            return math.MaxInt64
+        }
+    }
+    case KindFloat:
+        return int64(self.Float())
+    default:
+        return 0
+    }
+}
+
+// Float returns the value of a float or an integer, rounded to float64.
+func (self *Value) Float() float64 {
+    switch self.Kind() {
+    case KindInt: {
+        result, _ := new(big.Float).SetInt(self.scalar.(*big.Int)).Float64()
+        return result
+    }
+    case KindFloat:
+        switch self.scalar.(type) {
+        case float64:
+            return self.scalar.(float64)
+        case float32:
+            return float64(self.scalar.(float32))
+        case *big.Float: {
+            result, _ := self.scalar.(*big.Float).Float64()
+            return result
+        }
+        case json.Number: {
+            result, _ := strconv.ParseFloat(string(self.scalar.(json.Number)), 64)
+            return result
+        }
+        }
+    }
+    return 0
+}
+
+func (self *Value) Str() string {
+    if self == nil {
+        return ""
+    }
+    result, _ := self.scalar.(string)
+    return result
+}
+
+func (self *Value) Bytes() []byte {
+    if self == nil {
+        return nil
+    }
+    result, _ := self.scalar.([]byte)
+    return result
+}
+
+// Len returns the number of items of an array, the number of keys of an
+// object, or the length of a string or blob.
+func (self *Value) Len() int {
+    switch self.Kind() {
+    case KindArray:
+        return len(self.items)
+    case KindObject:
+        return len(self.fields)
+    case KindString:
+        return len(self.scalar.(string))
+    case KindBlob:
+        return len(self.scalar.([]byte))
+    default:
+        return 0
+    }
+}
+
+func (self *Value) Index(index int) *Value {
+    if self.Kind() != KindArray || index < 0 || index >= len(self.items) {
+        return nil
+    }
+    return self.items[index]
+}
+
+// Items returns the items of an array. The slice must not be modified.
+func (self *Value) Items() []*Value {
+    if self.Kind() != KindArray {
+        return nil
+    }
+    return self.items
+}
+
+func (self *Value) Get(key interface{}) *Value {
+    if self.Kind() != KindObject {
+        return nil
+    }
+    return self.fields[normalize_key(key)]
+}
+
+// Keys returns the keys of an object in a stable order: strings first,
+// sorted, then integers in numeric order, then any other keys.
+func (self *Value) Keys() []interface{} {
+    if self.Kind() != KindObject {
+        return nil
+    }
+    result := make([]interface{}, 0, len(self.fields))
+    for key := range self.fields {
+        result = append(result, key)
+    }
+    sort_keys(result)
+    return result
+}
+
+// Set stores item under key in an object. It does nothing on other kinds.
+func (self *Value) Set(key interface{}, item *Value) {
+    if self.Kind() == KindObject {
+        self.fields[normalize_key(key)] = item
+    }
+}
+
+func (self *Value) Delete(key interface{}) {
+    if self.Kind() == KindObject {
+        delete(self.fields, normalize_key(key))
+    }
+}
+
+// SetIndex replaces an item of an array, reporting whether index was in range.
+func (self *Value) SetIndex(index int, item *Value) bool {
+    if self.Kind() != KindArray || index < 0 || index >= len(self.items) {
+        return false
+    }
+    self.items[index] = item
+    return true
+}
+
+func (self *Value) Append(items ...*Value) {
+    if self.Kind() == KindArray {
+        self.items = append(self.items, items...)
+    }
+}
+
+// Insert inserts item before index, which may equal Len() to append.
+func (self *Value) Insert(index int, item *Value) bool {
+    if self.Kind() != KindArray || index < 0 || index > len(self.items) {
+        return false
+    }
+    self.items = append(self.items, nil)
+    copy(self.items[index+1:], self.items[index:])
+    self.items[index] = item
+    return true
+}
+
+func (self *Value) RemoveIndex(index int) bool {
+    if self.Kind() != KindArray || index < 0 || index >= len(self.items) {
+        return false
+    }
+    self.items = append(self.items[:index], self.items[index+1:]...)
+    return true
+}
+
+// Interface converts the tree back to the values Decoder produces for an
+// interface{} destination. Undefined and unspecified values become nil.
+func (self *Value) Interface() interface{} {
+    result := self.generic(false)
+    switch result.(type) {
+    case undefined, unspecified:
+        return nil
+    }
+    return result
+}
+
+// generic converts the tree to the values dump_value accepts. With exact,
+// 80-bit floats are kept as float80, which dump_value writes back unchanged
+// rather than as JSON literals.
+func (self *Value) generic(exact bool) interface{} {
+    switch self.Kind() {
+    case KindUndefined:
+        return undefined_value
+    case KindUnspecified:
+        return unspecified_value
+    case KindArray: {
+        result := make([]interface{}, len(self.items))
+        for i, item := range self.items {
+            result[i] = item.generic(exact)
+        }
+        return result
+    }
+    case KindObject: {
+        result := make(map[interface{}]interface{}, len(self.fields))
+        for key, item := range self.fields {
+            result[key] = item.generic(exact)
+        }
+        return result
+    }
+    case KindFloat:
+        if number, ok := self.scalar.(*big.Float); ok && exact {
+            return float80{ number }
+        }
+        return self.scalar
+    default:
+        return self.scalar
+    }
+}
+
+// value_from_generic builds a tree from the output of load_value.
+func value_from_generic(generic_value interface{}) *Value {
+    switch generic_value.(type) {
+    case nil:
+        return NewNull()
+    case undefined:
+        return NewUndefined()
+    case unspecified:
+        return NewUnspecified()
+    case bool:
+        return NewBool(generic_value.(bool))
+    case *big.Int:
+        return &Value{ kind: KindInt, scalar: generic_value }
+    case json.Number: {
+        number := json_number_to_generic(generic_value.(json.Number))
+        if _, ok := number.(*big.Int); ok {
+            return &Value{ kind: KindInt, scalar: number }
+        }
+        return &Value{ kind: KindFloat, scalar: generic_value }
+    }
+    case float32, float64, *big.Float:
+        return &Value{ kind: KindFloat, scalar: generic_value }
+    case string:
+        return NewString(generic_value.(string))
+    case []byte:
+        return NewBlob(generic_value.([]byte))
+    case []interface{}: {
+        generic_array := generic_value.([]interface{})
+        result := &Value{ kind: KindArray, items: make([]*Value, len(generic_array)) }
+        for i, item := range generic_array {
+            result.items[i] = value_from_generic(item)
+        }
+        return result
+    }
+    case []map[interface{}]interface{}: {
+        generic_array := generic_value.([]map[interface{}]interface{})
+        result := &Value{ kind: KindArray, items: make([]*Value, len(generic_array)) }
+        for i, item := range generic_array {
+            result.items[i] = value_from_generic(item)
+        }
+        return result
+    }
+    case map[interface{}]interface{}: {
+        generic_map := generic_value.(map[interface{}]interface{})
+        result := &Value{ kind: KindObject, fields: make(map[interface{}]*Value, len(generic_map)) }
+        for key, item := range generic_map {
+            result.fields[normalize_key(key)] = value_from_generic(item)
+        }
+        return result
+    }
+    default:
+        return &Value{ kind: KindNull }
+    }
+}
+
+func normalize_key(key interface{}) interface{} {
+    value := reflect.ValueOf(key)
+    switch value.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return value.Int()
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        if value.Uint() <= math.MaxInt64 {
+            return int64(value.Uint())
+        }
+        return new(big.Int).SetUint64(value.Uint())
+    }
+    if key_int, ok := key.(*big.Int); ok && key_int.IsInt64() {
+        return key_int.Int64()
+    }
+    return key
+}
+
+// sort_keys orders object keys: strings first, sorted, then integers in
+// numeric order, then any other keys by their printed form.
+func sort_keys(keys []interface{}) {
+    rank := func(key interface{}) int {
+        switch key.(type) {
+        case string:
+            return 0
+        case int64, *big.Int:
+            return 1
+        default:
+            return 2
+        }
+    }
+    sort.SliceStable(keys, func(i, j int) bool {
+        rank_i, rank_j := rank(keys[i]), rank(keys[j])
+        if rank_i != rank_j {
+            return rank_i < rank_j
+        }
+        switch rank_i {
+        case 0:
+            return keys[i].(string) < keys[j].(string)
+        case 1:
+            return key_to_big_int(keys[i]).Cmp(key_to_big_int(keys[j])) < 0
+        default:
+            return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+        }
+    })
+}
+
+func key_to_big_int(key interface{}) *big.Int {
+    if key_int, ok := key.(int64); ok {
+        return big.NewInt(key_int)
+    }
+    return key.(*big.Int)
+}
+
+// Pointer looks up a value by a JSON Pointer (RFC 6901) such as "/users/3".
+// A reference token selects an object key equal to the token, or, if there
+// is none, an integer key with that decimal value.
+func (self *Value) Pointer(pointer string) (*Value, error) {
+    tokens, err := parse_pointer(pointer)
+    if err != nil {
+        return nil, err
+    }
+    current := self
+    for i, token := range tokens {
+        current = current.child(token)
+        if current == nil {
+            return nil, errors.New("jksn: JSON pointer " + strconv.Quote(pointer) + " not found at " + strconv.Quote(format_pointer(tokens[:i+1])))
+        }
+    }
+    return current, nil
+}
+
+// SetPointer stores item at a JSON Pointer. The parent must exist. An object
+// key is added or replaced; an array index replaces an item, while an index
+// equal to the length, or "-", appends. The root cannot be set to nil.
+func (self *Value) SetPointer(pointer string, item *Value) error {
+    parent, token, err := self.pointer_parent(pointer)
+    if err != nil {
+        return err
+    }
+    if parent == nil {
+        if item == nil {
+            return errors.New("jksn: cannot set the root value to nil")
+        }
+        *self = *item
+        return nil
+    }
+    switch parent.Kind() {
+    case KindObject:
+        parent.fields[parent.pointer_key(token)] = item
+        return nil
+    case KindArray: {
+        index, ok := pointer_index(token, len(parent.items))
+        if ok && index == len(parent.items) {
+            parent.items = append(parent.items, item)
+            return nil
+        } else if ok {
+            parent.items[index] = item
+            return nil
+        }
+    }
+    }
+    return errors.New("jksn: JSON pointer " + strconv.Quote(pointer) + " not found")
+}
+
+// RemovePointer deletes the value at a JSON Pointer.
+func (self *Value) RemovePointer(pointer string) error {
+    parent, token, err := self.pointer_parent(pointer)
+    if err != nil {
+        return err
+    }
+    if parent == nil {
+        return errors.New("jksn: cannot remove the root value")
+    }
+    if parent.child(token) == nil {
+        return errors.New("jksn: JSON pointer " + strconv.Quote(pointer) + " not found")
+    }
+    switch parent.Kind() {
+    case KindObject:
+        delete(parent.fields, parent.pointer_key(token))
+    case KindArray: {
+        index, _ := pointer_index(token, len(parent.items))
+        parent.RemoveIndex(index)
+    }
+    }
+    return nil
+}
+
+// pointer_parent returns the container holding the value at pointer and the
+// last reference token, or a nil parent for the root pointer "".
+func (self *Value) pointer_parent(pointer string) (parent *Value, token string, err error) {
+    tokens, err := parse_pointer(pointer)
+    if err != nil || len(tokens) == 0 {
+        return nil, "", err
+    }
+    parent, err = self.Pointer(format_pointer(tokens[:len(tokens)-1]))
+    return parent, tokens[len(tokens)-1], err
+}
+
+func (self *Value) child(token string) *Value {
+    switch self.Kind() {
+    case KindObject:
+        return self.fields[self.pointer_key(token)]
+    case KindArray:
+        if index, ok := pointer_index(token, len(self.items)); ok && index < len(self.items) {
+            return self.items[index]
+        }
+    }
+    return nil
+}
+
+// pointer_key maps a reference token to the key it selects in an object.
+func (self *Value) pointer_key(token string) interface{} {
+    if _, ok := self.fields[token]; ok {
+        return token
+    }
+    if key, ok := new(big.Int).SetString(token, 10); ok && key.String() == token {
+        if _, found := self.fields[normalize_key(key)]; found {
+            return normalize_key(key)
+        }
+    }
+    return token
+}
+
+// pointer_index parses an array reference token into an index up to length,
+// where "-" stands for length.
+func pointer_index(token string, length int) (int, bool) {
+    if token == "-" {
+        return length, true
+    }
+    // Only 0 or digits without a leading zero, so no sign
+    if token == "" || (len(token) > 1 && token[0] == '0') || strings.Trim(token, "0123456789") != "" {
+        return 0, false
+    }
+    index, err := strconv.Atoi(token)
+    if err != nil || index < 0 || index > length {
+        return 0, false
+    }
+    return index, true
+}
+
+func parse_pointer(pointer string) ([]string, error) {
+    if pointer == "" {
+        return nil, nil
+    }
+    if pointer[0] != '/' {
+        return nil, errors.New("jksn: JSON pointer must start with '/': " + strconv.Quote(pointer))
+    }
+    tokens := strings.Split(pointer[1:], "/")
+    for i, token := range tokens {
+        tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+    }
+    return tokens, nil
+}
+
+func format_pointer(tokens []string) string {
+    var result strings.Builder
+    for _, token := range tokens {
+        result.WriteByte('/')
+        result.WriteString(strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1"))
+    }
+    return result.String()
+}
@@ -0,0 +1,77 @@
+/*
+  Copyright (c) 2015 StarBrilliant <m13253@hotmail.com>
+  All rights reserved.
+ 
+  Redistribution and use in source and binary forms are permitted
+  provided that the above copyright notice and this paragraph are
+  duplicated in all such forms and that any documentation,
+  advertising materials, and other materials related to such
+  distribution and use acknowledge that the software was developed by
+  StarBrilliant.
+  The name of StarBrilliant may not be used to endorse or promote
+  products derived from this software without specific prior written
+  permission.
+ 
+  THIS SOFTWARE IS PROVIDED ``AS IS'' AND WITHOUT ANY EXPRESS OR
+  IMPLIED WARRANTIES, INCLUDING, WITHOUT LIMITATION, THE IMPLIED
+  WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.
+*/
+
+package jksn
+
+import (
+    "math/rand"
+    "strconv"
+    "testing"
+)
+
+// random_value makes a small value, with objects mixing string and integer
+// keys which often collide in their pointer tokens.
+func random_value(random *rand.Rand, depth int) *Value {
+    kind := random.Intn(8)
+    if depth > 3 {
+        kind = random.Intn(5)
+    }
+    switch kind {
+    case 0:
+        return NewNull()
+    case 1:
+        return NewBool(random.Intn(2) == 0)
+    case 2:
+        return NewInt(int64(random.Intn(5)))
+    case 3:
+        return NewFloat(float64(random.Intn(5)) / 2)
+    case 4:
+        return NewString(strconv.Itoa(random.Intn(5)))
+    case 5, 6: {
+        result := NewArray()
+        for i := random.Intn(5); i > 0; i-- {
+            result.Append(random_value(random, depth+1))
+        }
+        return result
+    }
+    default: {
+        result := NewObject()
+        for i := random.Intn(5); i > 0; i-- {
+            if random.Intn(2) == 0 {
+                result.Set(int64(random.Intn(4)), random_value(random, depth+1))
+            } else {
+                result.Set(strconv.Itoa(random.Intn(4)), random_value(random, depth+1))
+            }
+        }
+        return result
+    }
+    }
+}
+
+func copy_value(t *testing.T, value *Value) *Value {
+    data, err := Marshal(value)
+    if err != nil {
+        t.Fatal(err)
+    }
+    result := new(Value)
+    if err := Unmarshal(data, result); err != nil {
+        t.Fatal(err)
+    }
+    return result
+}